@@ -2,54 +2,65 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/mlange-42/ark-repl/internal/monitor"
+	"github.com/mlange-42/ark-repl/internal/protocol"
 )
 
 // CLI arguments.
 type CLI struct {
-	Address string   `arg:"" help:"Server address to connect to ('host:port' or just ':port'). Default: localhost:9000" default:"localhost:9000"`
-	Run     []string `help:"REPL commands to run on startup." short:"r" name:"run" placeholder:"COMMAND"`
+	Address  string        `arg:"" help:"Server address to connect to ('host:port', just ':port', or 'unix:///path/to.sock'). Default: localhost:9000" default:"localhost:9000"`
+	Run      []string      `help:"REPL commands to run on startup." short:"r" name:"run" placeholder:"COMMAND"`
+	Token    string        `help:"Authentication token, if required by the server." env:"ARK_REPL_TOKEN"`
+	TLS      bool          `help:"Connect using TLS." name:"tls"`
+	CA       string        `help:"PEM file with CA certificate(s) to verify the server. Implies --tls." name:"ca" type:"existingfile" placeholder:"FILE"`
+	Insecure bool          `help:"Skip verification of the server certificate. Implies --tls."`
+	Server   string        `help:"Host name to verify the server certificate against. Default: host of the address, or localhost for Unix domain sockets. Implies --tls." name:"server-name" placeholder:"NAME"`
+	Timeout  time.Duration `help:"Timeout for commands to be executed by the simulation (e.g. 30s). Default: server's default."`
 }
 
 func main() {
 	var cli CLI
 	kong.Parse(&cli)
+	os.Exit(run(&cli))
+}
+
+// run the client. Returns the exit code,
+// which is non-zero if the connection failed or the last command failed.
+func run(cli *CLI) int {
 	addr := normalizeAddress(cli.Address)
 
-	conn, err := net.Dial("tcp", addr)
+	conn, err := dial(cli, addr)
 	if err != nil {
 		fmt.Println("Failed to connect:", err)
-		return
+		return 1
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	// The server may already have closed the connection, e.g. after exit or shutdown.
+	// Over TLS, closing then fails to send the close notification, which is harmless.
+	defer func() { _ = conn.Close() }()
+
+	client, err := protocol.NewClient(conn, cli.Token)
+	if err != nil {
+		fmt.Println("Failed to connect:", err)
+		return 1
+	}
+
+	client.SetTimeout(cli.Timeout)
 
 	fmt.Println("Connected to Ark REPL.")
-	serverReader := bufio.NewReader(conn)
+	fmt.Print(client.Greeting())
 	clientReader := bufio.NewScanner(os.Stdin)
-
-	// Read initial greeting and first prompt
-	for {
-		line, err := serverReader.ReadString('\n')
-		if err != nil {
-			fmt.Println("Connection closed.")
-			return
-		}
-		trimmed := strings.TrimSpace(line)
-		if trimmed == ">" {
-			break // first prompt received, stop greeting phase
-		}
-		fmt.Print(line)
-	}
+	code := 0
 
 	for {
 		// Show local prompt
@@ -67,30 +78,66 @@ func main() {
 			input = clientReader.Text()
 		}
 
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
 		if input == "monitor" {
-			_ = monitor.New(&monitor.RemoteConnection{Conn: conn})
+			if _, err := monitor.New(context.Background(), &monitor.RemoteConnection{Client: client}); err != nil {
+				fmt.Println("Failed to run monitor:", err)
+				code = 1
+			}
 			continue
 		}
 
-		// Send command to server
-		if _, err := fmt.Fprintln(conn, input); err != nil {
-			panic(err)
+		// Send command to server and stream its output until the result arrives.
+		// Ctrl+C cancels the command if it is still queued, and stops streaming commands like trace.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		resp, err := client.ExecStream(ctx, input, os.Stdout)
+		stop()
+		if err != nil {
+			fmt.Println("Connection closed:", err)
+			return 1
+		}
+		code = 0
+		if resp.Error != "" {
+			fmt.Println(resp.Error)
+			code = 1
 		}
+		if resp.Status == protocol.StatusExit {
+			break
+		}
+	}
+	return code
+}
 
-		// Read response until next prompt
-		for {
-			line, err := serverReader.ReadString('\n')
-			if err != nil {
-				fmt.Println("Connection closed.")
-				return
-			}
-			trimmed := strings.TrimSpace(line)
-			if trimmed == ">" {
-				break // prompt received, ready for next input
-			}
-			fmt.Print(line)
+func dial(cli *CLI, addr string) (net.Conn, error) {
+	network, address := protocol.ParseAddress(addr)
+	if !cli.TLS && cli.CA == "" && !cli.Insecure && cli.Server == "" {
+		return net.Dial(network, address)
+	}
+
+	config := tls.Config{
+		InsecureSkipVerify: cli.Insecure,
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cli.Server,
+	}
+	if config.ServerName == "" && network == "unix" {
+		// Otherwise, the socket path would be used.
+		config.ServerName = "localhost"
+	}
+	if cli.CA != "" {
+		pem, err := os.ReadFile(cli.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in '%s'", cli.CA)
 		}
+		config.RootCAs = pool
 	}
+	return tls.Dial(network, address, &config)
 }
 
 func normalizeAddress(input string) string {
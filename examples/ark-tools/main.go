@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"strings"
 
 	"github.com/mlange-42/ark-repl/examples"
@@ -40,9 +41,11 @@ func main() {
 	app.AddUISystem(repl.System())
 
 	// For control from this terminal:
-	repl.Start()
+	if err := repl.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-	// For control from another terminal:
+	// For control from another terminal (can be combined with the above):
 	//repl.StartServer(":9000")
 
 	app.Run()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"strings"
 	"time"
 
@@ -37,9 +38,11 @@ func main() {
 	repl := repl.NewRepl(&world, callbacks)
 
 	// For control from this terminal:
-	repl.Start()
+	if err := repl.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-	// For control from another terminal:
+	// For control from another terminal (can be combined with the above):
 	//repl.StartServer(":9000")
 
 	// Update loop.
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -57,9 +58,11 @@ func main() {
 	repl.AddCommand("custom", customCommand{})
 
 	// For control from this terminal:
-	repl.Start()
+	if err := repl.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-	// For control from another terminal:
+	// For control from another terminal (can be combined with the above):
 	//repl.StartServer(":9000")
 
 	// Update loop.
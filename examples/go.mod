@@ -3,7 +3,7 @@ module github.com/mlange-42/ark-repl/examples
 go 1.25.0
 
 require (
-	github.com/mlange-42/ark v0.5.3-0.20251008110420-1182eceb0eea
+	github.com/mlange-42/ark v0.6.1
 	github.com/mlange-42/ark-repl v0.0.0
 	github.com/mlange-42/ark-tools v0.1.5
 )
@@ -22,4 +22,5 @@ require (
 	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/term v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,12 +1,10 @@
 package monitor
 
 import (
-	"bufio"
 	"fmt"
-	"net"
-	"strings"
 
 	"github.com/goccy/go-json"
+	"github.com/mlange-42/ark-repl/internal/protocol"
 	arkstats "github.com/mlange-42/ark/ecs/stats"
 )
 
@@ -24,36 +22,21 @@ type Stats struct {
 
 // RemoteConnection implements Connection.
 type RemoteConnection struct {
-	Conn net.Conn
+	Client *protocol.Client
 }
 
 // Get stats.
 func (s *RemoteConnection) Get() (Stats, error) {
-	out := strings.Builder{}
-
-	serverReader := bufio.NewReader(s.Conn)
 	st := Stats{}
-
-	// Send command to server
-	if _, err := fmt.Fprintln(s.Conn, "stats-json"); err != nil {
+	resp, err := s.Client.Exec("stats-json")
+	if err != nil {
 		return st, err
 	}
-
-	// Read response
-	for {
-		line, err := serverReader.ReadString('\n')
-		if err != nil {
-			fmt.Println("Connection closed.")
-			return st, err
-		}
-		trimmed := strings.TrimSpace(line)
-		if trimmed == ">" {
-			break // prompt received, ready for next input
-		}
-		fmt.Fprint(&out, line)
+	if resp.Status != protocol.StatusOk {
+		return st, fmt.Errorf("failed to get stats: %s", resp.Error)
 	}
 
-	if err := json.Unmarshal([]byte(out.String()), &st); err != nil {
+	if err := json.Unmarshal([]byte(resp.Output), &st); err != nil {
 		return st, err
 	}
 	return st, nil
@@ -61,22 +44,12 @@ func (s *RemoteConnection) Get() (Stats, error) {
 
 // Exec a command.
 func (s *RemoteConnection) Exec(cmd string) error {
-	serverReader := bufio.NewReader(s.Conn)
-	if _, err := fmt.Fprintln(s.Conn, cmd); err != nil {
+	resp, err := s.Client.Exec(cmd)
+	if err != nil {
 		return err
 	}
-
-	// Read response
-	for {
-		line, err := serverReader.ReadString('\n')
-		if err != nil {
-			fmt.Println("Connection closed.")
-			return err
-		}
-		trimmed := strings.TrimSpace(line)
-		if trimmed == ">" {
-			break // prompt received, ready for next input
-		}
+	if resp.Status == protocol.StatusError {
+		return fmt.Errorf("failed to execute '%s': %s", cmd, resp.Error)
 	}
 	return nil
 }
@@ -3,7 +3,6 @@ package monitor
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/mum4k/termdash"
@@ -54,7 +53,9 @@ type Monitor struct {
 }
 
 // New monitor TUI.
-func New(stats Connection) *Monitor {
+//
+// Blocks until the user quits, the context is canceled, or the connection fails.
+func New(ctx context.Context, stats Connection) (*Monitor, error) {
 	terminal := tcellTerminal
 
 	var t terminalapi.Terminal
@@ -65,33 +66,33 @@ func New(stats Connection) *Monitor {
 	case tcellTerminal:
 		t, err = tcell.New(tcell.ColorMode(terminalapi.ColorMode256))
 	default:
-		log.Fatalf("Unknown terminal implementation '%s' specified. Please choose between 'termbox' and 'tcell'.", terminal)
-		return nil
+		return nil, fmt.Errorf("unknown terminal implementation '%s' specified; please choose between 'termbox' and 'tcell'", terminal)
 	}
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer t.Close()
 
 	c, err := container.New(t, container.ID(rootID))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	w, err := newWidgets()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	gridOpts, err := layout(w)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	if err := c.Update(rootID, gridOpts...); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	monitor := &Monitor{
@@ -100,7 +101,7 @@ func New(stats Connection) *Monitor {
 		cont:    c,
 	}
 
-	go periodic(ctx, 1000*time.Millisecond, monitor.update)
+	go periodic(ctx, cancel, 1000*time.Millisecond, monitor.update)
 
 	quitter := func(k *terminalapi.Keyboard) {
 		if k.Key == keyboard.KeyEsc || k.Key == keyboard.KeyCtrlC {
@@ -117,15 +118,15 @@ func New(stats Connection) *Monitor {
 		}
 		if cmd != "" {
 			if err := stats.Exec(cmd); err != nil {
-				panic(err)
+				cancel()
 			}
 		}
 	}
 	if err := termdash.Run(ctx, t, c, termdash.KeyboardSubscriber(quitter), termdash.RedrawInterval(redrawInterval)); err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return monitor
+	return monitor, nil
 }
 
 func (m *Monitor) update() error {
@@ -252,10 +253,10 @@ func layout(w *widgets) ([]container.Option, error) {
 
 	help, err := text.New()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if err := help.Write("Help: [Esc]ape [P]ause [R]esume [S]hrink"); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	outer := []container.Option{
@@ -270,15 +271,16 @@ func layout(w *widgets) ([]container.Option, error) {
 }
 
 // periodic executes the provided closure periodically every interval.
-// Exits when the context expires.
-func periodic(ctx context.Context, interval time.Duration, fn func() error) {
+// Exits when the context expires, or cancels it when the closure fails.
+func periodic(ctx context.Context, cancel context.CancelFunc, interval time.Duration, fn func() error) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			if err := fn(); err != nil {
-				panic(err)
+				cancel()
+				return
 			}
 		case <-ctx.Done():
 			return
@@ -0,0 +1,311 @@
+// Package protocol implements the framed wire protocol between the REPL server and its clients.
+//
+// After connecting, the server sends a plain-text greeting terminated by a prompt line (">").
+// Clients that understand the framed protocol answer with a [TypeHello] message.
+// From then on, both sides exchange newline-delimited JSON messages.
+// Output of long-running commands is streamed in [TypeOutput] chunks before the final [TypeResult].
+// Clients that do not send a hello message (e.g. nc) are served in plain-text mode.
+//
+// If the server requires authentication, framed clients send the token with the hello message,
+// while plain-text clients must send "auth <token>" as their first line.
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Version of the protocol.
+const Version = 2
+
+// UnixScheme is the address prefix for Unix domain sockets, like "unix:///path/to.sock".
+const UnixScheme = "unix://"
+
+// AuthCommand is the command plain-text clients use to authenticate, followed by the token.
+const AuthCommand = "auth"
+
+// Prompt is the line sent by the server in plain-text mode when it is ready for input.
+const Prompt = ">"
+
+// MaxRequestSize is the maximum size of a line sent by a client, in bytes, including the newline.
+// It applies to the first line and to messages of the framed protocol.
+const MaxRequestSize = 1 << 20
+
+// ErrTooLong is returned when a line exceeds the size limit.
+var ErrTooLong = errors.New("line too long")
+
+// MessageType of a [Message].
+type MessageType string
+
+// Message types.
+const (
+	// TypeHello is sent by the client to start the framed protocol, and echoed by the server.
+	TypeHello MessageType = "hello"
+	// TypeExec requests the execution of a command.
+	TypeExec MessageType = "exec"
+	// TypeResult is the response to a [TypeExec] message.
+	// It contains the output that was not sent in [TypeOutput] chunks before.
+	TypeResult MessageType = "result"
+	// TypeOutput is a chunk of a command's output, sent while the command is executing.
+	TypeOutput MessageType = "output"
+	// TypeClose is sent by the server before it closes the connection, e.g. on shutdown.
+	TypeClose MessageType = "close"
+	// TypeCancel requests cancellation of a queued command, referenced by its ID.
+	// Commands that are already executing are not affected.
+	TypeCancel MessageType = "cancel"
+)
+
+// Status of a [TypeResult] message.
+type Status string
+
+// Response statuses.
+const (
+	// StatusOk indicates successful execution.
+	StatusOk Status = "ok"
+	// StatusError indicates a failed command.
+	StatusError Status = "error"
+	// StatusBusy indicates a command rejected because the server's command queue is full.
+	StatusBusy Status = "busy"
+	// StatusExit indicates that the server closes the session.
+	StatusExit Status = "exit"
+)
+
+// Message envelope of the framed protocol.
+type Message struct {
+	Type     MessageType     `json:"type"`
+	ID       uint64          `json:"id,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	Token    string          `json:"token,omitempty"`
+	Command  string          `json:"command,omitempty"`
+	Timeout  int64           `json:"timeout,omitempty"`   // In milliseconds; zero for the server's default.
+	WithData bool            `json:"with_data,omitempty"` // Requests the structured result in Data.
+	Status   Status          `json:"status,omitempty"`
+	Output   string          `json:"output,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"` // Structured result of the command, if any and requested.
+}
+
+// ParseAddress splits an address into network and address, as used by [net.Dial] and [net.Listen].
+//
+// Addresses starting with [UnixScheme] are Unix domain sockets, all others are TCP addresses.
+func ParseAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// ReadMessage reads the next message from a reader.
+// Fails with [ErrTooLong] if the message is longer than limit bytes, unless limit is zero.
+func ReadMessage(r *bufio.Reader, limit int) (Message, error) {
+	msg := Message{}
+	line, err := ReadLine(r, limit)
+	if err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return msg, fmt.Errorf("invalid message: %w", err)
+	}
+	return msg, nil
+}
+
+// ReadLine reads until the next newline, like [bufio.Reader.ReadBytes].
+// Fails with [ErrTooLong] if the line is longer than limit bytes, unless limit is zero.
+// The rest of a line that is too long is not consumed.
+func ReadLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if limit > 0 && len(line) > limit {
+			return nil, ErrTooLong
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// WriteMessage writes a message to a writer and flushes it.
+func WriteMessage(w *bufio.Writer, msg *Message) error {
+	enc, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(enc); err != nil {
+		return err
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ParseHello checks whether a line is a [TypeHello] message.
+func ParseHello(line []byte) (Message, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return Message{}, false
+	}
+	msg := Message{}
+	if err := json.Unmarshal(line, &msg); err != nil || msg.Type != TypeHello {
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// Client for the framed protocol.
+// It is safe for concurrent use.
+type Client struct {
+	mu       sync.Mutex
+	writeMu  sync.Mutex
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	nextID   uint64
+	greeting string
+	timeout  time.Duration
+	withData bool
+}
+
+// NewClient creates a new client and performs the handshake.
+//
+// The token is only required if the server is configured for authentication.
+func NewClient(conn io.ReadWriter, token string) (*Client, error) {
+	c := Client{
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	greeting := strings.Builder{}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == Prompt {
+			break
+		}
+		greeting.WriteString(line)
+	}
+	c.greeting = greeting.String()
+
+	if err := c.write(&Message{Type: TypeHello, Version: Version, Token: token}); err != nil {
+		return nil, err
+	}
+	resp, err := ReadMessage(c.reader, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != TypeHello {
+		return nil, fmt.Errorf("unexpected handshake response of type '%s'", resp.Type)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("handshake rejected: %s", resp.Error)
+	}
+	return &c, nil
+}
+
+// Greeting returns the server's greeting text.
+func (c *Client) Greeting() string {
+	return c.greeting
+}
+
+// SetTimeout sets the timeout for commands to be executed by the simulation.
+// Zero uses the server's default.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+}
+
+// SetWithData sets whether results contain the structured result of commands as JSON data.
+// Off by default, as the server only encodes results for output formats other than text otherwise.
+func (c *Client) SetWithData(withData bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.withData = withData
+}
+
+// Exec sends a command to the server and waits for the result.
+func (c *Client) Exec(cmd string) (Message, error) {
+	return c.ExecContext(context.Background(), cmd)
+}
+
+// ExecContext sends a command to the server and waits for the result.
+// The result contains the complete output of the command.
+//
+// If the context is canceled before the result arrives, the server is asked to cancel the command.
+// The result is still awaited, as the command may already be executing.
+func (c *Client) ExecContext(ctx context.Context, cmd string) (Message, error) {
+	out := strings.Builder{}
+	resp, err := c.ExecStream(ctx, cmd, &out)
+	resp.Output = out.String()
+	return resp, err
+}
+
+// ExecStream sends a command to the server and writes its output to w as it arrives.
+// The output field of the returned result is empty.
+//
+// See [Client.ExecContext] for cancellation.
+func (c *Client) ExecStream(ctx context.Context, cmd string, w io.Writer) (Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := c.nextID
+	msg := Message{Type: TypeExec, ID: id, Command: cmd, Timeout: c.timeout.Milliseconds(), WithData: c.withData}
+	if err := c.write(&msg); err != nil {
+		// The server may have sent a close message before closing the connection.
+		if resp, rerr := ReadMessage(c.reader, 0); rerr == nil && resp.Type == TypeClose {
+			return resp, fmt.Errorf("closed by server: %s", resp.Output)
+		}
+		return Message{}, err
+	}
+
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.write(&Message{Type: TypeCancel, ID: id})
+		case <-received:
+		}
+	}()
+
+	// On write errors, the remaining output is still consumed to keep the connection usable.
+	var writeErr error
+	for {
+		resp, err := ReadMessage(c.reader, 0)
+		if err != nil {
+			return resp, err
+		}
+		if resp.Type == TypeClose {
+			return resp, fmt.Errorf("closed by server: %s", resp.Output)
+		}
+		if (resp.Type != TypeResult && resp.Type != TypeOutput) || resp.ID != id {
+			return resp, fmt.Errorf("unexpected response of type '%s' for request %d (expected %d)", resp.Type, resp.ID, id)
+		}
+		if writeErr == nil {
+			_, writeErr = io.WriteString(w, resp.Output)
+		}
+		if resp.Type == TypeResult {
+			resp.Output = ""
+			return resp, writeErr
+		}
+	}
+}
+
+func (c *Client) write(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return WriteMessage(c.writer, msg)
+}
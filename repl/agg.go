@@ -0,0 +1,331 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// groupArchetype is the value of the agg command's by option for grouping by archetype.
+const groupArchetype = "archetype"
+
+type agg struct {
+	Fields    []string  `help:"Fields to aggregate, like Position.X,Agent.Kind."`
+	By        string    `help:"Group by 'archetype' or by a field."`
+	Quantiles []float64 `default:"0.25,0.5,0.75" help:"Quantiles to compute for numeric fields."`
+	Comps     []string  `help:"Components of the query."`
+	With      []string  `help:"Additional components to filter for."`
+	Without   []string  `help:"Only entities without these components."`
+	Exclusive bool      `help:"Only entities with exactly the components in 'with'."`
+	Where     string    `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string  `help:"Relation targets, like ChildOf:5."`
+}
+
+func (c agg) Run(world *ecs.World, out io.Writer) (any, error) {
+	if len(c.Fields) == 0 {
+		return nil, errors.New("no fields given; use fields=<Component.Field>,...")
+	}
+	fields, err := resolveFieldList(world, c.Fields)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]valueKind, len(fields))
+	for i := range fields {
+		kind, ok := fieldKind(fields[i].typ)
+		if !ok {
+			return nil, fmt.Errorf("can't aggregate '%s' of type %s; only numbers, strings and bools are supported", fields[i].name, fields[i].typ)
+		}
+		kinds[i] = kind
+	}
+	for _, q := range c.Quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %g; must be between 0 and 1", q)
+		}
+	}
+
+	groupBy, err := newGrouper(world, c.By)
+	if err != nil {
+		return nil, err
+	}
+	required := slices.Clone(fields)
+	if groupBy.field != nil {
+		required = append(required, *groupBy.field)
+	}
+
+	groups := []string{}
+	values := map[string][]aggValues{}
+	spec := filterSpec{comps: c.Comps, with: c.With, without: c.Without, exclusive: c.Exclusive, where: c.Where, rel: c.Rel}
+	err = forEachEntity(world, spec, required, func(query *ecs.UnsafeQuery) {
+		group := groupBy.group(query)
+		vals, ok := values[group]
+		if !ok {
+			vals = make([]aggValues, len(fields))
+			values[group] = vals
+			groups = append(groups, group)
+		}
+		for i := range fields {
+			vals[i].add(kinds[i], fields[i].value(query.Get))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]aggRow, 0, len(groups)*len(fields))
+	for _, group := range groups {
+		for i := range fields {
+			row := values[group][i].aggregate(c.Quantiles)
+			row.Group = group
+			row.grouped = c.By != ""
+			row.Field = fields[i].name
+			rows = append(rows, row)
+		}
+	}
+
+	if len(rows) == 0 {
+		fmt.Fprintln(out, "No matching entities")
+		return rows, nil
+	}
+	if err := writeAggTable(out, rows, c.Quantiles); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c agg) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Aggregate component fields: count, distinct, sum, mean, std, min, max and quantiles.")
+	fmt.Fprintln(out, "Numeric fields get all statistics, string and bool fields only count and distinct.")
+	fmt.Fprintln(out, "Supports the same filters as query.")
+}
+
+// grouper determines the group of entities for the agg command.
+type grouper struct {
+	field     *fieldPath
+	archetype bool
+	names     map[string]string
+	compNames []string
+	key       []byte
+}
+
+func newGrouper(world *ecs.World, by string) (*grouper, error) {
+	switch by {
+	case "":
+		return &grouper{}, nil
+	case groupArchetype:
+		allIDs := ecs.ComponentIDs(world)
+		compNames := make([]string, len(allIDs))
+		for i, id := range allIDs {
+			info, _ := ecs.ComponentInfo(world, id)
+			compNames[i] = info.Type.Name()
+		}
+		return &grouper{archetype: true, names: map[string]string{}, compNames: compNames}, nil
+	}
+	field, err := resolveField(world, by)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fieldKind(field.typ); !ok {
+		return nil, fmt.Errorf("can't group by '%s' of type %s; only numbers, strings and bools are supported", by, field.typ)
+	}
+	return &grouper{field: &field}, nil
+}
+
+// group returns the group of the current entity.
+func (g *grouper) group(query *ecs.UnsafeQuery) string {
+	if g.field != nil {
+		return fmt.Sprint(g.field.value(query.Get).Interface())
+	}
+	if !g.archetype {
+		return ""
+	}
+	ids := query.IDs()
+	g.key = g.key[:0]
+	for i := range ids.Len() {
+		g.key = append(g.key, ids.Get(i).Index())
+	}
+	if name, ok := g.names[string(g.key)]; ok {
+		return name
+	}
+	names := make([]string, ids.Len())
+	for i := range ids.Len() {
+		names[i] = g.compNames[ids.Get(i).Index()]
+	}
+	name := "[" + strings.Join(names, " ") + "]"
+	g.names[string(g.key)] = name
+	return name
+}
+
+// aggValues collects the values of a field.
+type aggValues struct {
+	numbers    []float64
+	categories map[string]int
+}
+
+func (a *aggValues) add(kind valueKind, v reflect.Value) {
+	if kind == kindNumber {
+		a.numbers = append(a.numbers, numberValue(v))
+		return
+	}
+	if a.categories == nil {
+		a.categories = map[string]int{}
+	}
+	a.categories[fmt.Sprint(v.Interface())]++
+}
+
+// aggregate computes statistics of the collected values.
+func (a *aggValues) aggregate(quantiles []float64) aggRow {
+	if a.categories != nil {
+		row := aggRow{Distinct: len(a.categories)}
+		for _, n := range a.categories {
+			row.Count += n
+		}
+		return row
+	}
+
+	values := a.numbers
+	slices.Sort(values)
+	row := aggRow{
+		Count:     len(values),
+		numeric:   true,
+		Min:       values[0],
+		Max:       values[len(values)-1],
+		Quantiles: make([]float64, len(quantiles)),
+	}
+	for i, v := range values {
+		row.Sum += v
+		if i == 0 || v != values[i-1] {
+			row.Distinct++
+		}
+	}
+	row.Mean = row.Sum / float64(len(values))
+	if len(values) > 1 {
+		sumSq := 0.0
+		for _, v := range values {
+			sumSq += (v - row.Mean) * (v - row.Mean)
+		}
+		row.Std = math.Sqrt(sumSq / float64(len(values)-1))
+	}
+	for i, q := range quantiles {
+		row.Quantiles[i] = quantile(values, q)
+		row.quantileNames = append(row.quantileNames, quantileName(q))
+	}
+	return row
+}
+
+// quantile of sorted values, with linear interpolation between closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// quantileName returns the column name for a quantile, like "p25" for 0.25.
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'g', -1, 64)
+}
+
+// aggRow is the structured result of the agg command for a field and group.
+// Statistics other than count and distinct are only available for numeric fields.
+type aggRow struct {
+	Group     string
+	Field     string
+	Count     int
+	Distinct  int
+	Sum       float64
+	Mean      float64
+	Std       float64
+	Min       float64
+	Max       float64
+	Quantiles []float64
+
+	grouped       bool
+	numeric       bool
+	quantileNames []string
+}
+
+// MarshalJSON encodes the row with quantiles as separate keys, like "p25".
+func (r aggRow) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	write := func(key string, value any) error {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		enc, err := marshalJSON(value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.Quote(key))
+		buf.WriteByte(':')
+		buf.Write(enc)
+		return nil
+	}
+
+	keys := []string{}
+	vals := []any{}
+	if r.grouped {
+		keys = append(keys, "group")
+		vals = append(vals, r.Group)
+	}
+	keys = append(keys, "field", "count", "distinct")
+	vals = append(vals, r.Field, r.Count, r.Distinct)
+	if r.numeric {
+		keys = append(keys, "sum", "mean", "std", "min", "max")
+		vals = append(vals, r.Sum, r.Mean, r.Std, r.Min, r.Max)
+		for i, q := range r.Quantiles {
+			keys = append(keys, r.quantileNames[i])
+			vals = append(vals, q)
+		}
+	}
+	for i, key := range keys {
+		if err := write(key, vals[i]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// writeAggTable writes the rows of the agg command as an aligned table.
+func writeAggTable(out io.Writer, rows []aggRow, quantiles []float64) error {
+	header := []string{"field", "count", "distinct", "sum", "mean", "std", "min", "max"}
+	for _, q := range quantiles {
+		header = append(header, quantileName(q))
+	}
+	if rows[0].grouped {
+		header = append([]string{"group"}, header...)
+	}
+
+	cells := make([][]string, len(rows))
+	for i, r := range rows {
+		row := []string{}
+		if r.grouped {
+			row = append(row, r.Group)
+		}
+		row = append(row, r.Field, strconv.Itoa(r.Count), strconv.Itoa(r.Distinct))
+		if r.numeric {
+			for _, v := range append([]float64{r.Sum, r.Mean, r.Std, r.Min, r.Max}, r.Quantiles...) {
+				row = append(row, formatNumber(v))
+			}
+		}
+		for len(row) < len(header) {
+			row = append(row, "-")
+		}
+		cells[i] = row
+	}
+	return writeTable(out, header, cells)
+}
+
+// formatNumber formats a float with up to 6 significant digits.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
@@ -1,14 +1,20 @@
 package repl
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"slices"
 	"strings"
+	"time"
+	"unsafe"
 
 	"github.com/goccy/go-json"
 	"github.com/mlange-42/ark-repl/internal/monitor"
 	"github.com/mlange-42/ark/ecs"
+	arkstats "github.com/mlange-42/ark/ecs/stats"
 )
 
 // Command interface.
@@ -19,8 +25,73 @@ type Command interface {
 	Help(out *strings.Builder)
 }
 
+// Runner is an extended command interface that reports failure and structured results.
+//
+// Run writes human-readable output to out, and returns an optional result value and an error.
+// Errors are reported to clients with an error status.
+// Results are encoded as JSON right after Run returns, so they can reference world data.
+// They are sent to clients of the framed protocol, and rendered if the user selects
+// an output format other than text (see the "format" command).
+//
+// Implement this instead of [Command] for custom commands that can fail.
+// Register with [Repl.AddRunner].
+type Runner interface {
+	Run(world *ecs.World, out io.Writer) (any, error)
+	Help(out *strings.Builder)
+}
+
+// helper is implemented by both [Command] and [Runner].
+type helper interface {
+	Help(out *strings.Builder)
+}
+
+// streamer is implemented by built-in commands that span multiple ticks, like diff.
+//
+// Instead of being executed by [Repl.Poll], stream is called by the session and runs
+// until the command is finished or the context is canceled.
+// The stop hint tells the user how to stop the command in the current session.
+// The result is only encoded if encode is true; otherwise, nil is returned.
+// It must access the world only through [Repl.execStep].
+type streamer interface {
+	helper
+	stream(ctx context.Context, timeout time.Duration, stopHint string, encode bool, out io.Writer) (*snapshot, error)
+}
+
+// liveStreamer is implemented by streamers whose text output is shown in all output formats,
+// as it can't be replaced by the final result, like the events of trace.
+type liveStreamer interface {
+	streamer
+	liveOutput()
+}
+
+// runFunc adapts a function to a [Runner], for executing steps of a [streamer].
+type runFunc func(world *ecs.World, out io.Writer) (any, error)
+
+func (f runFunc) Run(world *ecs.World, out io.Writer) (any, error) {
+	return f(world, out)
+}
+
+func (f runFunc) Help(_ *strings.Builder) {}
+
+// run executes a [Command] or [Runner].
+func run(cmd helper, world *ecs.World, out io.Writer) (any, error) {
+	switch cmd := cmd.(type) {
+	case Runner:
+		return cmd.Run(world, out)
+	case Command:
+		b, ok := out.(*strings.Builder)
+		if !ok {
+			b = &strings.Builder{}
+			defer func() { _, _ = io.WriteString(out, b.String()) }()
+		}
+		cmd.Execute(world, b)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("type %T implements neither Command nor Runner", cmd)
+}
+
 type commandEntry struct {
-	command Command
+	command helper
 	visible bool
 }
 
@@ -28,7 +99,7 @@ type help struct {
 	repl *Repl
 }
 
-func (c help) Execute(_ *ecs.World, out *strings.Builder) {
+func (c help) Run(_ *ecs.World, out io.Writer) (any, error) {
 	cmds := make([]string, 0, len(c.repl.commands))
 	help := make(map[string]string, len(c.repl.commands))
 	for cmd, obj := range c.repl.commands {
@@ -52,6 +123,7 @@ func (c help) Execute(_ *ecs.World, out *strings.Builder) {
 	for _, c := range cmds {
 		fmt.Fprintf(out, "  %-12s %s\n", c, help[c])
 	}
+	return nil, nil
 }
 
 func (c help) Help(out *strings.Builder) {
@@ -62,13 +134,15 @@ type pause struct {
 	repl *Repl
 }
 
-func (c pause) Execute(_ *ecs.World, out *strings.Builder) {
+func (c pause) Run(_ *ecs.World, out io.Writer) (any, error) {
 	if c.repl.callbacks.Pause == nil {
-		fmt.Fprint(out, "No pause callback provided\n")
-		return
+		return nil, errors.New("no pause callback provided")
 	}
-	c.repl.callbacks.Pause(out)
+	var b strings.Builder
+	c.repl.callbacks.Pause(&b)
+	fmt.Fprint(out, b.String())
 	fmt.Fprint(out, "Simulation paused\n")
+	return nil, nil
 }
 
 func (c pause) Help(out *strings.Builder) {
@@ -79,13 +153,15 @@ type resume struct {
 	repl *Repl
 }
 
-func (c resume) Execute(_ *ecs.World, out *strings.Builder) {
+func (c resume) Run(_ *ecs.World, out io.Writer) (any, error) {
 	if c.repl.callbacks.Resume == nil {
-		fmt.Fprint(out, "No resume callback provided\n")
-		return
+		return nil, errors.New("no resume callback provided")
 	}
-	c.repl.callbacks.Resume(out)
+	var b strings.Builder
+	c.repl.callbacks.Resume(&b)
+	fmt.Fprint(out, b.String())
 	fmt.Fprint(out, "Simulation resumed\n")
+	return nil, nil
 }
 
 func (c resume) Help(out *strings.Builder) {
@@ -96,13 +172,15 @@ type stop struct {
 	repl *Repl
 }
 
-func (c stop) Execute(_ *ecs.World, out *strings.Builder) {
+func (c stop) Run(_ *ecs.World, out io.Writer) (any, error) {
 	if c.repl.callbacks.Stop == nil {
-		fmt.Fprint(out, "No stop callback provided\n")
-		return
+		return nil, errors.New("no stop callback provided")
 	}
-	c.repl.callbacks.Stop(out)
+	var b strings.Builder
+	c.repl.callbacks.Stop(&b)
+	fmt.Fprint(out, b.String())
 	fmt.Fprint(out, "Simulation terminated\n")
+	return nil, nil
 }
 
 func (c stop) Help(out *strings.Builder) {
@@ -111,17 +189,55 @@ func (c stop) Help(out *strings.Builder) {
 
 type exit struct{}
 
-func (c exit) Execute(_ *ecs.World, _ *strings.Builder) {}
+func (c exit) Run(_ *ecs.World, _ io.Writer) (any, error) {
+	return nil, nil
+}
 
 func (c exit) Help(out *strings.Builder) {
 	fmt.Fprintln(out, "Exit the REPL without stopping the simulation.")
 }
 
+// formatCmd is handled by the session, as it changes the session's settings.
+type formatCmd struct{}
+
+func (c formatCmd) Run(_ *ecs.World, _ io.Writer) (any, error) {
+	return nil, nil
+}
+
+func (c formatCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Show or set the default output format of the session.")
+	fmt.Fprintf(out, "Usage: format [%s]\n", strings.Join(formatNames(), "|"))
+	fmt.Fprintln(out, "Use option format=<name> to select the format of a single command.")
+}
+
 type stats struct{}
 
-func (c stats) Execute(world *ecs.World, out *strings.Builder) {
+func (c stats) Run(world *ecs.World, out io.Writer) (any, error) {
 	stats := world.Stats()
 	fmt.Fprint(out, stats)
+	return statsResult{stats}, nil
+}
+
+// statsResult is the structured result of the stats command.
+type statsResult struct {
+	*arkstats.World
+}
+
+// tableData returns world-level statistics, without archetype details.
+func (s statsResult) tableData() any {
+	return struct {
+		Entities      arkstats.Entities
+		Components    int
+		Archetypes    int
+		Memory        int
+		MemoryUsed    int
+		CachedFilters int
+		Observers     int
+		Locked        bool
+	}{
+		s.Entities, len(s.ComponentTypeNames), len(s.Archetypes),
+		s.Memory, s.MemoryUsed, s.CachedFilters, s.Observers, s.Locked,
+	}
 }
 
 func (c stats) Help(out *strings.Builder) {
@@ -135,86 +251,131 @@ type query struct {
 	With      []string `help:"Additional components to filter for."`
 	Without   []string `help:"Only entities without these components."`
 	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
-	Full      bool     `help:"Show all components, not only those queried."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+	Sort      string   `help:"Sort by fields, like \"Velocity.X desc,Position.Y\"."`
+	Fields    []string `help:"Components or fields to show, like Position.X,Velocity."`
+	Full      bool     `help:"Show all components, not only those queried. Always the case if no comps are given."`
 }
 
-func (c query) Execute(world *ecs.World, out *strings.Builder) {
-	comps, err := getComponentIDs(world, c.Comps)
-	if err != nil {
-		fmt.Fprintln(out, err.Error())
-		return
-	}
+// queryResult is the structured result of the query command.
+type queryResult struct {
+	Total    int           `json:"total"`
+	Page     int           `json:"page"`
+	Pages    int           `json:"pages"`
+	Entities []entityValue `json:"entities"`
+}
 
-	allIDs := ecs.ComponentIDs(world)
-	compTypes := make([]reflect.Type, 0, len(allIDs))
-	for _, id := range allIDs {
-		info, _ := ecs.ComponentInfo(world, id)
-		compTypes = append(compTypes, info.Type)
-	}
+// tableData returns the listed entities.
+func (r queryResult) tableData() any {
+	return r.Entities
+}
+
+// entityValue is an entity with its component values and relation targets, by component type name.
+type entityValue struct {
+	Entity     ecs.Entity            `json:"entity"`
+	Components map[string]any        `json:"components"`
+	Relations  map[string]ecs.Entity `json:"relations,omitempty"`
+}
 
-	with, err := getComponentIDs(world, c.With)
+func (c query) Run(world *ecs.World, out io.Writer) (any, error) {
+	fields, err := resolveFieldList(world, c.Fields)
 	if err != nil {
-		fmt.Fprintln(out, err.Error())
-		return
+		return nil, err
 	}
-	allComps := make([]ecs.ID, 0, len(comps)+len(with))
-	allComps = append(allComps, comps...)
-	allComps = append(allComps, with...)
-
-	without, err := getComponentIDs(world, c.Without)
+	keys, err := parseSortKeys(world, c.Sort)
 	if err != nil {
-		fmt.Fprintln(out, err.Error())
-		return
+		return nil, err
+	}
+	require := make([]ecs.ID, 0, len(fields)+len(keys))
+	for _, f := range fields {
+		require = append(require, f.comp)
+	}
+	for _, k := range keys {
+		require = append(require, k.field.comp)
 	}
 
-	filter := ecs.NewUnsafeFilter(world, allComps...).Without(without...)
-	if c.Exclusive {
-		filter = filter.Exclusive()
+	filter, err := newFilter(world, filterSpec{
+		comps: c.Comps, with: c.With, without: c.Without,
+		exclusive: c.Exclusive, where: c.Where, rel: c.Rel, require: require,
+	})
+	if err != nil {
+		return nil, err
 	}
-	query := filter.Query()
+	where := filter.where
+	// Without queried components, like for where or with only, show the entity's components.
+	printer := newEntityPrinter(world, filter.comps, fields, c.Full || len(filter.comps) == 0)
+
+	query := filter.query()
+	closed := false
+	defer func() {
+		// Unlock the world if printing a component panicked.
+		if !closed {
+			query.Close()
+		}
+	}()
 	cnt := 0
 	shown := 0
 	total := query.Count()
+	result := queryResult{Page: c.Page, Entities: []entityValue{}}
 
-	if c.N > 0 {
-		compStrings := make([]string, 0, len(comps))
-		show := []ecs.ID{}
-
-		start := c.Page * c.N
-		end := (c.Page + 1) * c.N
-		for query.Next() {
-			if cnt < start {
-				cnt++
-				continue
+	start := c.Page * c.N
+	end := (c.Page + 1) * c.N
+	var rows []sortRow
+	for query.Next() {
+		if where != nil && !where.eval(query.Get) {
+			continue
+		}
+		if len(keys) > 0 {
+			// Print after sorting.
+			rows = append(rows, newSortRow(query.Entity(), query.Get, keys))
+			cnt++
+			continue
+		}
+		if cnt >= start && cnt < end {
+			value, err := printer.print(out, query.Entity(), query.Get, query.IDs, query.GetRelation)
+			if err != nil {
+				return nil, err
 			}
+			result.Entities = append(result.Entities, value)
+			shown++
+		}
+		cnt++
+		// Without a where filter or sorting, the total is known, so the remaining entities can be skipped.
+		if where == nil && cnt >= end {
+			query.Close()
+			break
+		}
+	}
+	closed = true
+	if where != nil || len(keys) > 0 {
+		total = cnt
+	}
 
-			if c.Full {
-				ids := query.IDs()
-				for i := range ids.Len() {
-					show = append(show, ids.Get(i))
-				}
-			} else {
-				show = append(show, comps...)
-			}
-			for _, id := range show {
-				ptr := query.Get(id)
-				val := reflect.NewAt(compTypes[id.Index()], ptr).Elem()
-				compStrings = append(compStrings, fmt.Sprintf("%s%+v", compTypes[id.Index()].Name(), val.Interface()))
+	if len(keys) > 0 && start < len(rows) {
+		sortRows(rows, keys)
+		u := world.Unsafe()
+		for _, row := range rows[start:min(end, len(rows))] {
+			get := func(id ecs.ID) unsafe.Pointer { return u.Get(row.entity, id) }
+			ids := func() ecs.IDs { return u.IDs(row.entity) }
+			rel := func(id ecs.ID) ecs.Entity { return u.GetRelation(row.entity, id) }
+			value, err := printer.print(out, row.entity, get, ids, rel)
+			if err != nil {
+				return nil, err
 			}
-
-			fmt.Fprintf(out, "%v: ", query.Entity())
-			fmt.Fprintln(out, strings.Join(compStrings, " "))
-			cnt++
+			result.Entities = append(result.Entities, value)
 			shown++
-			if cnt >= end {
-				query.Close()
-				break
-			}
-			compStrings = compStrings[:0]
-			show = show[:0]
 		}
 	}
-	fmt.Fprintf(out, "Listed %d of %d entities (page %d of %d)\n", shown, total, c.Page, (total+c.N-1)/c.N)
+
+	result.Total = total
+	if c.N > 0 {
+		result.Pages = (total + c.N - 1) / c.N
+		fmt.Fprintf(out, "Listed %d of %d entities (page %d of %d)\n", shown, total, c.Page, result.Pages)
+		return result, nil
+	}
+	fmt.Fprintf(out, "Listed 0 of %d entities\n", total)
+	return result, nil
 }
 
 func (c query) Help(out *strings.Builder) {
@@ -224,7 +385,13 @@ func (c query) Help(out *strings.Builder) {
 type shrink struct {
 }
 
-func (c shrink) Execute(world *ecs.World, out *strings.Builder) {
+// shrinkResult is the structured result of the shrink command, in bytes.
+type shrinkResult struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+func (c shrink) Run(world *ecs.World, out io.Writer) (any, error) {
 	oldMem := world.Stats().Memory
 	world.Shrink()
 	newMem := world.Stats().Memory
@@ -234,6 +401,7 @@ func (c shrink) Execute(world *ecs.World, out *strings.Builder) {
 	} else {
 		fmt.Fprintf(out, "Shrink had no effect: %s\n", formatMemory(newMem))
 	}
+	return shrinkResult{Before: oldMem, After: newMem}, nil
 }
 
 func (c shrink) Help(out *strings.Builder) {
@@ -246,8 +414,9 @@ type list struct {
 	Archetypes listArchetypes
 }
 
-func (c list) Execute(_ *ecs.World, out *strings.Builder) {
+func (c list) Run(_ *ecs.World, out io.Writer) (any, error) {
 	fmt.Fprintln(out, "Lists various things. Run `help list` for details.")
+	return nil, nil
 }
 
 func (c list) Help(out *strings.Builder) {
@@ -258,19 +427,27 @@ type listResources struct {
 	Length int `default:"100" help:"Maximum string length per resource to print."`
 }
 
-func (c listResources) Execute(world *ecs.World, out *strings.Builder) {
+// typeInfo is the structured result for a resource or component type.
+type typeInfo struct {
+	ID    uint8  `json:"id"`
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+func (c listResources) Run(world *ecs.World, out io.Writer) (any, error) {
 	allRes := ecs.ResourceIDs(world)
 	padIDs := numDigits(len(allRes))
-	cnt := 0
+	result := make([]typeInfo, 0, len(allRes))
 	for _, id := range allRes {
 		res := world.Resources().Get(id)
 		str := truncateString(fmt.Sprintf("%#v", res), c.Length)
 		fmt.Fprintf(out, "%*d: %s\n", padIDs, id.Index(), str)
-		cnt++
+		result = append(result, typeInfo{ID: id.Index(), Type: reflect.TypeOf(res).String(), Value: str})
 	}
-	if cnt == 0 {
+	if len(result) == 0 {
 		fmt.Fprint(out, "No resources\n")
 	}
+	return result, nil
 }
 
 func (c listResources) Help(out *strings.Builder) {
@@ -279,19 +456,20 @@ func (c listResources) Help(out *strings.Builder) {
 
 type listComponents struct{}
 
-func (c listComponents) Execute(world *ecs.World, out *strings.Builder) {
+func (c listComponents) Run(world *ecs.World, out io.Writer) (any, error) {
 	allComp := ecs.ComponentIDs(world)
 	padIDs := numDigits(len(allComp))
-	cnt := 0
+	result := make([]typeInfo, 0, len(allComp))
 	for _, id := range allComp {
 		if info, ok := ecs.ComponentInfo(world, id); ok {
 			fmt.Fprintf(out, "%*d: %s\n", padIDs, id.Index(), info.Type.String())
-			cnt++
+			result = append(result, typeInfo{ID: id.Index(), Type: info.Type.String()})
 		}
 	}
-	if cnt == 0 {
+	if len(result) == 0 {
 		fmt.Fprint(out, "No components\n")
 	}
+	return result, nil
 }
 
 func (c listComponents) Help(out *strings.Builder) {
@@ -300,7 +478,15 @@ func (c listComponents) Help(out *strings.Builder) {
 
 type listArchetypes struct{}
 
-func (c listArchetypes) Execute(world *ecs.World, out *strings.Builder) {
+// archetypeInfo is the structured result for an archetype.
+type archetypeInfo struct {
+	ID         int      `json:"id"`
+	Entities   int      `json:"entities"`
+	Tables     int      `json:"tables"`
+	Components []string `json:"components"`
+}
+
+func (c listArchetypes) Run(world *ecs.World, out io.Writer) (any, error) {
 	stats := world.Stats()
 
 	maxEntities := 0
@@ -317,10 +503,13 @@ func (c listArchetypes) Execute(world *ecs.World, out *strings.Builder) {
 	padIDs := numDigits(len(stats.Archetypes))
 	padEntities := numDigits(maxEntities)
 	padTables := numDigits(maxTable)
+	result := make([]archetypeInfo, 0, len(stats.Archetypes))
 	for i := range stats.Archetypes {
 		arch := &stats.Archetypes[i]
 		fmt.Fprintf(out, "%*d: %*d entities, %*d table(s)  %s\n", padIDs, i, padEntities, arch.Size, padTables, len(arch.Tables), strings.Join(arch.ComponentTypeNames, " "))
+		result = append(result, archetypeInfo{ID: i, Entities: arch.Size, Tables: len(arch.Tables), Components: arch.ComponentTypeNames})
 	}
+	return result, nil
 }
 
 func (c listArchetypes) Help(out *strings.Builder) {
@@ -329,8 +518,9 @@ func (c listArchetypes) Help(out *strings.Builder) {
 
 type runTui struct{}
 
-func (c runTui) Execute(_ *ecs.World, out *strings.Builder) {
+func (c runTui) Run(_ *ecs.World, out io.Writer) (any, error) {
 	fmt.Fprintln(out, "MONITOR")
+	return nil, nil
 }
 
 func (c runTui) Help(out *strings.Builder) {
@@ -341,7 +531,7 @@ type getStats struct {
 	repl *Repl
 }
 
-func (c getStats) Execute(world *ecs.World, out *strings.Builder) {
+func (c getStats) Run(world *ecs.World, out io.Writer) (any, error) {
 	stats := world.Stats()
 
 	ticks := 0
@@ -356,10 +546,12 @@ func (c getStats) Execute(world *ecs.World, out *strings.Builder) {
 
 	enc, err := json.Marshal(&s)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(out, "%s\n", enc); err != nil {
+		return nil, err
 	}
-	out.Write(enc)
-	out.WriteRune('\n')
+	return s, nil
 }
 
 func (c getStats) Help(out *strings.Builder) {
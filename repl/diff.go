@@ -0,0 +1,336 @@
+package repl
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+type diff struct {
+	repl  *Repl
+	File  string   `positional:"" help:"Snapshot file saved with 'save'. The option name can be omitted."`
+	Ticks int      `help:"Take a snapshot now, and compare to it after this number of ticks."`
+	Comps []string `help:"Only show changes of these components."`
+}
+
+// diffResult is the structured result of the diff command.
+type diffResult struct {
+	Created []entityChange `json:"created"`
+	Removed []entityChange `json:"removed"`
+	Changed []entityChange `json:"changed"`
+}
+
+// entityChange describes the differences of an entity between two snapshots.
+// Components are listed for created and removed entities.
+type entityChange struct {
+	Entity     ecs.Entity    `json:"entity"`
+	Components []string      `json:"components,omitempty"`
+	Added      []string      `json:"added,omitempty"`
+	Removed    []string      `json:"removed,omitempty"`
+	Fields     []fieldChange `json:"fields,omitempty"`
+}
+
+// fieldChange is a changed field value or relation target.
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+// diffRow is a row of the diff command's table output.
+type diffRow struct {
+	Entity ecs.Entity `json:"entity"`
+	Change string     `json:"change"`
+	Field  string     `json:"field"`
+	Old    any        `json:"old"`
+	New    any        `json:"new"`
+}
+
+// tableData returns one row per created or removed entity, and per change of an entity.
+func (r diffResult) tableData() any {
+	rows := []diffRow{}
+	for _, e := range r.Created {
+		rows = append(rows, diffRow{Entity: e.Entity, Change: "created", Field: strings.Join(e.Components, " ")})
+	}
+	for _, e := range r.Removed {
+		rows = append(rows, diffRow{Entity: e.Entity, Change: "removed", Field: strings.Join(e.Components, " ")})
+	}
+	for _, e := range r.Changed {
+		for _, comp := range e.Added {
+			rows = append(rows, diffRow{Entity: e.Entity, Change: "comp added", Field: comp})
+		}
+		for _, comp := range e.Removed {
+			rows = append(rows, diffRow{Entity: e.Entity, Change: "comp removed", Field: comp})
+		}
+		for _, f := range e.Fields {
+			rows = append(rows, diffRow{Entity: e.Entity, Change: "changed", Field: f.Field, Old: f.Old, New: f.New})
+		}
+	}
+	return rows
+}
+
+func (c diff) stream(ctx context.Context, timeout time.Duration, _ string, encode bool, out io.Writer) (*snapshot, error) {
+	if c.File != "" && c.Ticks > 0 {
+		return nil, errors.New("can't use a snapshot file together with ticks")
+	}
+	if c.File == "" && c.Ticks <= 0 {
+		return nil, errors.New("no snapshot given; use diff <file> or diff ticks=<n>")
+	}
+
+	if c.File != "" {
+		base, err := readSnapshot(c.File)
+		if err != nil {
+			return nil, err
+		}
+		return c.repl.execStep(ctx, timeout, func(world *ecs.World, out io.Writer) (any, error) {
+			return c.compare(world, base, out)
+		}, encode, out)
+	}
+
+	var base *worldSnapshot
+	start := 0
+	_, err := c.repl.execStep(ctx, timeout, func(world *ecs.World, _ io.Writer) (any, error) {
+		// Check components before waiting.
+		if _, err := getComponentIDs(world, c.Comps); err != nil {
+			return nil, err
+		}
+		start = c.repl.tick()
+		var err error
+		base, err = takeWorldSnapshot(world)
+		return nil, err
+	}, false, out)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail if the simulation polls, but does not tick, like when it is paused.
+	limit := timeout
+	if limit <= 0 {
+		limit = c.repl.commandTimeout()
+	}
+	last, lastChange := start, time.Now()
+	for {
+		if err := c.repl.waitPoll(ctx, timeout); err != nil {
+			return nil, err
+		}
+		tick, done := 0, false
+		result, err := c.repl.execStep(ctx, timeout, func(world *ecs.World, out io.Writer) (any, error) {
+			tick = c.repl.tick()
+			if tick-start < c.Ticks {
+				return nil, nil
+			}
+			done = true
+			return c.compare(world, base, out)
+		}, encode, out)
+		if err != nil || done {
+			return result, err
+		}
+		if tick != last {
+			last, lastChange = tick, time.Now()
+		} else if limit > 0 && time.Since(lastChange) > limit {
+			return nil, fmt.Errorf("%w: simulation did not tick within %s; it may be paused", ErrTimeout, limit)
+		}
+	}
+}
+
+// compare compares the current world to a snapshot and writes the differences.
+func (c diff) compare(world *ecs.World, base *worldSnapshot, out io.Writer) (any, error) {
+	var only map[string]bool
+	if len(c.Comps) > 0 {
+		ids, err := getComponentIDs(world, c.Comps)
+		if err != nil {
+			return nil, err
+		}
+		only = map[string]bool{}
+		for _, id := range ids {
+			info, _ := ecs.ComponentInfo(world, id)
+			only[info.Type.String()] = true
+		}
+	}
+
+	current, err := takeWorldSnapshot(world)
+	if err != nil {
+		return nil, err
+	}
+	result, err := compareSnapshots(componentTypes(world), base, current, only)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range result.Created {
+		fmt.Fprintf(out, "+ %v [%s]\n", e.Entity, strings.Join(e.Components, " "))
+	}
+	for _, e := range result.Removed {
+		fmt.Fprintf(out, "- %v [%s]\n", e.Entity, strings.Join(e.Components, " "))
+	}
+	for _, e := range result.Changed {
+		fmt.Fprintf(out, "~ %v\n", e.Entity)
+		for _, comp := range e.Added {
+			fmt.Fprintf(out, "    + %s\n", comp)
+		}
+		for _, comp := range e.Removed {
+			fmt.Fprintf(out, "    - %s\n", comp)
+		}
+		for _, f := range e.Fields {
+			fmt.Fprintf(out, "    %s: %+v -> %+v\n", f.Field, f.Old, f.New)
+		}
+	}
+	fmt.Fprintf(out, "Created %d, removed %d, changed %d entities\n", len(result.Created), len(result.Removed), len(result.Changed))
+	return result, nil
+}
+
+func (c diff) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Compare the world to a snapshot saved with 'save', like 'diff world.json',")
+	fmt.Fprintln(out, "or find out what the next ticks change, like 'diff ticks=1'.")
+	fmt.Fprintln(out, "Shows created and removed entities, added and removed components, and changed field values.")
+	fmt.Fprintln(out, "Ticks are counted by the Ticks callback, or by calls to Poll without it.")
+	fmt.Fprintln(out, "Waiting for ticks fails if they don't advance within the timeout, and can be stopped like 'trace'.")
+}
+
+// compareSnapshots compares two world snapshots.
+// If only is not nil, only changes of the contained components are considered.
+func compareSnapshots(types map[string]ecs.CompInfo, old, current *worldSnapshot, only map[string]bool) (diffResult, error) {
+	result := diffResult{
+		Created: []entityChange{},
+		Removed: []entityChange{},
+		Changed: []entityChange{},
+	}
+	oldEntities := make(map[ecs.Entity]*entitySnapshot, len(old.Entities))
+	for i := range old.Entities {
+		oldEntities[old.Entities[i].Entity] = &old.Entities[i]
+	}
+	currentEntities := make(map[ecs.Entity]*entitySnapshot, len(current.Entities))
+	for i := range current.Entities {
+		currentEntities[current.Entities[i].Entity] = &current.Entities[i]
+	}
+
+	for i := range current.Entities {
+		e := &current.Entities[i]
+		o, ok := oldEntities[e.Entity]
+		if !ok {
+			comps := componentNames(types, e, only)
+			if only == nil || len(comps) > 0 {
+				result.Created = append(result.Created, entityChange{Entity: e.Entity, Components: comps})
+			}
+			continue
+		}
+		change, err := compareEntities(types, o, e, only)
+		if err != nil {
+			return result, err
+		}
+		if len(change.Added) > 0 || len(change.Removed) > 0 || len(change.Fields) > 0 {
+			result.Changed = append(result.Changed, change)
+		}
+	}
+	for i := range old.Entities {
+		o := &old.Entities[i]
+		if _, ok := currentEntities[o.Entity]; ok {
+			continue
+		}
+		comps := componentNames(types, o, only)
+		if only == nil || len(comps) > 0 {
+			result.Removed = append(result.Removed, entityChange{Entity: o.Entity, Components: comps})
+		}
+	}
+
+	for _, changes := range [][]entityChange{result.Created, result.Removed, result.Changed} {
+		slices.SortFunc(changes, func(a, b entityChange) int {
+			return cmp.Or(cmp.Compare(a.Entity.ID(), b.Entity.ID()), cmp.Compare(a.Entity.Gen(), b.Entity.Gen()))
+		})
+	}
+	return result, nil
+}
+
+// compareEntities compares the components of an entity in two snapshots.
+func compareEntities(types map[string]ecs.CompInfo, old, current *entitySnapshot, only map[string]bool) (entityChange, error) {
+	change := entityChange{Entity: current.Entity}
+	names := slices.Collect(maps.Keys(old.Components))
+	for name := range current.Components {
+		if _, ok := old.Components[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if only != nil && !only[name] {
+			continue
+		}
+		short := shortTypeName(types, name)
+		oldData, inOld := old.Components[name]
+		newData, inNew := current.Components[name]
+		if !inOld {
+			change.Added = append(change.Added, short)
+			continue
+		}
+		if !inNew {
+			change.Removed = append(change.Removed, short)
+			continue
+		}
+
+		if oldTarget, newTarget := old.Relations[name], current.Relations[name]; oldTarget != newTarget {
+			change.Fields = append(change.Fields, fieldChange{Field: short + " (target)", Old: oldTarget, New: newTarget})
+		}
+		if bytes.Equal(oldData, newData) {
+			continue
+		}
+		_, oldValue, err := decodeComponent(types, name, old.Entity, oldData)
+		if err != nil {
+			return change, err
+		}
+		_, newValue, err := decodeComponent(types, name, current.Entity, newData)
+		if err != nil {
+			return change, err
+		}
+		diffValues(short, oldValue, newValue, &change.Fields)
+	}
+	return change, nil
+}
+
+// diffValues appends the changed fields of two values of the same type.
+// Structs are compared field by field, other values as a whole.
+func diffValues(path string, old, current reflect.Value, changes *[]fieldChange) {
+	if old.Kind() == reflect.Struct && old.Type() != entityType {
+		for i := range old.NumField() {
+			field := old.Type().Field(i)
+			if !field.IsExported() || field.Type == relationMarkerType {
+				continue
+			}
+			diffValues(path+"."+field.Name, old.Field(i), current.Field(i), changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(old.Interface(), current.Interface()) {
+		*changes = append(*changes, fieldChange{Field: path, Old: old.Interface(), New: current.Interface()})
+	}
+}
+
+// componentNames returns the sorted short names of an entity's components.
+func componentNames(types map[string]ecs.CompInfo, e *entitySnapshot, only map[string]bool) []string {
+	names := []string{}
+	for _, name := range slices.Sorted(maps.Keys(e.Components)) {
+		if only == nil || only[name] {
+			names = append(names, shortTypeName(types, name))
+		}
+	}
+	return names
+}
+
+// shortTypeName returns the name of a component type without package,
+// or the full name if the type is not registered.
+func shortTypeName(types map[string]ecs.CompInfo, name string) string {
+	if info, ok := types[name]; ok {
+		return info.Type.Name()
+	}
+	return name
+}
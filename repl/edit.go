@@ -0,0 +1,314 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+type set struct {
+	Entity    string   `positional:"" help:"Entity as <id>[.<gen>]. Sets fields of all matching entities if not given."`
+	Values    []string `extra:"" help:"Field assignments like Position.X=10. The option name can be omitted."`
+	Comps     []string `help:"Components of the query."`
+	With      []string `help:"Additional components to filter for."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+// editResult is the structured result of commands that modify entities.
+// Entities are only listed when given or created individually.
+type editResult struct {
+	Count    int          `json:"count"`
+	Entities []ecs.Entity `json:"entities,omitempty"`
+}
+
+func (c set) Run(world *ecs.World, out io.Writer) (any, error) {
+	if len(c.Values) == 0 {
+		return nil, errors.New("no values given; use <Component.Field>=<value>")
+	}
+	assignments, err := parseAssignments(world, c.Values)
+	if err != nil {
+		return nil, err
+	}
+	result := editResult{}
+	spec := filterSpec{
+		comps: c.Comps, with: c.With, without: c.Without,
+		exclusive: c.Exclusive, where: c.Where, rel: c.Rel,
+	}
+
+	if c.Entity != "" {
+		entities, err := selectEntities(world, c.Entity, spec)
+		if err != nil {
+			return nil, err
+		}
+		entity := entities[0]
+		u := world.Unsafe()
+		for _, a := range assignments {
+			if !u.Has(entity, a.field.comp) {
+				return nil, fmt.Errorf("entity %v has no component %s", entity, a.field.compType.Name())
+			}
+		}
+		assign(assignments, func(id ecs.ID) unsafe.Pointer { return u.Get(entity, id) })
+		result.Count = 1
+		result.Entities = append(result.Entities, entity)
+		fmt.Fprintf(out, "Set %d field(s) of entity %v\n", len(assignments), entity)
+		return result, nil
+	}
+
+	fields := make([]fieldPath, len(assignments))
+	for i := range assignments {
+		fields[i] = assignments[i].field
+	}
+	err = forEachEntity(world, spec, fields, func(query *ecs.UnsafeQuery) {
+		assign(assignments, query.Get)
+		result.Count++
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Set %d field(s) of %d entities\n", len(assignments), result.Count)
+	return result, nil
+}
+
+func (c set) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Set component fields of an entity, like 'set 5 Position.X=10 Agent.State=hungry'.")
+	fmt.Fprintln(out, "Without an entity, sets the fields of all entities matching the filters, like for query.")
+	fmt.Fprintln(out, "Entity fields are given as <id>[.<gen>].")
+}
+
+type spawn struct {
+	N      int      `default:"1" help:"Number of entities to create."`
+	Comps  []string `help:"Components of the new entities."`
+	Values []string `extra:"" help:"Field initializers like Position.X=10. The option name can be omitted."`
+}
+
+func (c spawn) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.N < 1 {
+		return nil, errors.New("number of entities must be at least 1")
+	}
+	ids, assignments, err := componentsAndAssignments(world, c.Comps, c.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	u := world.Unsafe()
+	result := editResult{Count: c.N}
+	for range c.N {
+		entity := u.NewEntity(ids...)
+		assign(assignments, func(id ecs.ID) unsafe.Pointer { return u.Get(entity, id) })
+		result.Entities = append(result.Entities, entity)
+	}
+	if c.N == 1 {
+		fmt.Fprintf(out, "Created entity %v\n", result.Entities[0])
+	} else {
+		fmt.Fprintf(out, "Created %d entities, %v to %v\n", c.N, result.Entities[0], result.Entities[c.N-1])
+	}
+	return result, nil
+}
+
+func (c spawn) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Create entities, like 'spawn n=10 comps=Position Velocity.X=1'.")
+	fmt.Fprintln(out, "Components of initialized fields are added automatically.")
+}
+
+type despawn struct {
+	Entity    string   `positional:"" help:"Entity as <id>[.<gen>]. Removes all matching entities if not given."`
+	Comps     []string `help:"Components of the query."`
+	With      []string `help:"Additional components to filter for."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+func (c despawn) Run(world *ecs.World, out io.Writer) (any, error) {
+	spec := filterSpec{
+		comps: c.Comps, with: c.With, without: c.Without,
+		exclusive: c.Exclusive, where: c.Where, rel: c.Rel,
+	}
+	if c.Entity == "" && !spec.hasOptions() {
+		// Prevent accidentally removing all entities.
+		return nil, errors.New("no entity or filter given; use despawn <id>[.<gen>] or filter options like with=<Component>")
+	}
+	entities, err := selectEntities(world, c.Entity, spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		world.RemoveEntity(entity)
+	}
+	fmt.Fprintf(out, "Removed %d entities\n", len(entities))
+	return newEditResult(c.Entity, entities), nil
+}
+
+func (c despawn) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Remove an entity, like 'despawn 5', or all entities matching the filters.")
+}
+
+type comp struct {
+	Add    compAdd
+	Remove compRemove
+}
+
+func (c comp) Run(_ *ecs.World, out io.Writer) (any, error) {
+	fmt.Fprintln(out, "Adds or removes components. Run `help comp` for details.")
+	return nil, nil
+}
+
+func (c comp) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Adds or removes components.")
+}
+
+type compAdd struct {
+	Entity    string   `positional:"" help:"Entity as <id>[.<gen>]. Uses all matching entities if not given."`
+	Comps     []string `help:"Components to add."`
+	Values    []string `extra:"" help:"Field initializers like Position.X=10. The option name can be omitted."`
+	With      []string `help:"Only entities with these components."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+func (c compAdd) Run(world *ecs.World, out io.Writer) (any, error) {
+	ids, assignments, err := componentsAndAssignments(world, c.Comps, c.Values)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no components given; use comps=<Component> or <Component.Field>=<value>")
+	}
+	spec := filterSpec{
+		with: c.With, without: c.Without, exclusive: c.Exclusive,
+		where: c.Where, rel: c.Rel, exclude: ids,
+	}
+	entities, err := selectEntities(world, c.Entity, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	u := world.Unsafe()
+	for _, entity := range entities {
+		for _, id := range ids {
+			if u.Has(entity, id) {
+				info, _ := ecs.ComponentInfo(world, id)
+				return nil, fmt.Errorf("entity %v already has component %s", entity, info.Type.Name())
+			}
+		}
+	}
+	for _, entity := range entities {
+		u.Add(entity, ids...)
+		assign(assignments, func(id ecs.ID) unsafe.Pointer { return u.Get(entity, id) })
+	}
+	fmt.Fprintf(out, "Added %d component(s) to %d entities\n", len(ids), len(entities))
+	return newEditResult(c.Entity, entities), nil
+}
+
+func (c compAdd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Add components to an entity, like 'comp add 5 comps=Velocity Velocity.X=1'.")
+	fmt.Fprintln(out, "Without an entity, adds to all matching entities that don't have the components yet.")
+}
+
+type compRemove struct {
+	Entity    string   `positional:"" help:"Entity as <id>[.<gen>]. Uses all matching entities if not given."`
+	Comps     []string `help:"Components to remove."`
+	With      []string `help:"Only entities with these components."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+func (c compRemove) Run(world *ecs.World, out io.Writer) (any, error) {
+	ids, err := getComponentIDs(world, c.Comps)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no components given; use comps=<Component>")
+	}
+	spec := filterSpec{
+		with: c.With, without: c.Without, exclusive: c.Exclusive,
+		where: c.Where, rel: c.Rel, require: ids,
+	}
+	entities, err := selectEntities(world, c.Entity, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	u := world.Unsafe()
+	for _, entity := range entities {
+		for _, id := range ids {
+			if !u.Has(entity, id) {
+				info, _ := ecs.ComponentInfo(world, id)
+				return nil, fmt.Errorf("entity %v has no component %s", entity, info.Type.Name())
+			}
+		}
+	}
+	for _, entity := range entities {
+		u.Remove(entity, ids...)
+	}
+	fmt.Fprintf(out, "Removed %d component(s) from %d entities\n", len(ids), len(entities))
+	return newEditResult(c.Entity, entities), nil
+}
+
+func (c compRemove) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Remove components from an entity, like 'comp remove 5 comps=Velocity'.")
+	fmt.Fprintln(out, "Without an entity, removes from all matching entities that have the components.")
+}
+
+// componentsAndAssignments resolves component names and field assignments.
+// Returns the IDs of all given components and of all assigned fields.
+func componentsAndAssignments(world *ecs.World, comps []string, values []string) ([]ecs.ID, []assignment, error) {
+	ids, err := getComponentIDs(world, comps)
+	if err != nil {
+		return nil, nil, err
+	}
+	assignments, err := parseAssignments(world, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range assignments {
+		if !slices.Contains(ids, a.field.comp) {
+			ids = append(ids, a.field.comp)
+		}
+	}
+	return ids, assignments, nil
+}
+
+// selectEntities returns the given entity, or all entities matching the filter spec if no entity is given.
+func selectEntities(world *ecs.World, ref string, spec filterSpec) ([]ecs.Entity, error) {
+	if ref != "" {
+		if spec.hasOptions() {
+			return nil, errors.New("can't use filters together with an entity")
+		}
+		entity, err := resolveEntity(world, ref)
+		if err != nil {
+			return nil, err
+		}
+		return []ecs.Entity{entity}, nil
+	}
+
+	entities := []ecs.Entity{}
+	err := forEachEntity(world, spec, nil, func(query *ecs.UnsafeQuery) {
+		entities = append(entities, query.Entity())
+	})
+	return entities, err
+}
+
+// newEditResult creates the result for modified entities.
+// Entities are only listed if a single entity was given.
+func newEditResult(ref string, entities []ecs.Entity) editResult {
+	result := editResult{Count: len(entities)}
+	if ref != "" {
+		result.Entities = entities
+	}
+	return result
+}
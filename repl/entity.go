@@ -0,0 +1,199 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// Number of reserved entities at the start of the entity pool (zero and wildcard).
+const reservedEntities = 2
+
+var (
+	entityType         = reflect.TypeFor[ecs.Entity]()
+	relationMarkerType = reflect.TypeFor[ecs.RelationMarker]()
+)
+
+// resolveEntity resolves an entity reference like "5" or "5.0" to an alive entity.
+// Without a generation, the current generation of the ID is used.
+// Returns a descriptive error for dead or recycled entities.
+func resolveEntity(world *ecs.World, ref string) (ecs.Entity, error) {
+	idStr, genStr, hasGen := strings.Cut(ref, ".")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return ecs.Entity{}, fmt.Errorf("invalid entity '%s'; expected <id>[.<gen>]", ref)
+	}
+	var gen uint64
+	if hasGen {
+		if gen, err = strconv.ParseUint(genStr, 10, 32); err != nil {
+			return ecs.Entity{}, fmt.Errorf("invalid entity '%s'; expected <id>[.<gen>]", ref)
+		}
+	}
+
+	// Ark's liveness check doesn't check the range of the ID.
+	stats := world.Stats().Entities
+	if id < reservedEntities || id >= uint64(stats.Total+reservedEntities) {
+		return ecs.Entity{}, fmt.Errorf("entity %d does not exist", id)
+	}
+	// The liveness check only compares generations, and free IDs hold the generation of their next use.
+	// So it is only conclusive if there are no free IDs.
+	if hasGen && stats.Recycled == 0 {
+		if entity := newEntity(uint32(id), uint32(gen)); world.Alive(entity) {
+			return entity, nil
+		}
+	}
+
+	current, inUse := findEntity(world, uint32(id))
+	if !hasGen {
+		gen = uint64(current.Gen())
+	}
+
+	if inUse && uint64(current.Gen()) == gen {
+		return current, nil
+	}
+	if inUse {
+		return ecs.Entity{}, fmt.Errorf("entity {%d %d} is dead; ID %d was recycled as %v", id, gen, id, current)
+	}
+	if !hasGen {
+		return ecs.Entity{}, fmt.Errorf("entity ID %d is currently not in use", id)
+	}
+	return ecs.Entity{}, fmt.Errorf("entity {%d %d} is dead; ID %d is currently not in use", id, gen, id)
+}
+
+// findEntity returns the alive entity with the given ID, if any.
+// Ark has no lookup by ID, so entities are iterated until the ID is found.
+func findEntity(world *ecs.World, id uint32) (ecs.Entity, bool) {
+	query := ecs.NewUnsafeFilter(world).Query()
+	for query.Next() {
+		if entity := query.Entity(); entity.ID() == id {
+			query.Close()
+			return entity, true
+		}
+	}
+	return ecs.Entity{}, false
+}
+
+// newEntity creates an entity from an ID and a generation.
+// Ark has no constructor for entities, so it is deserialized.
+func newEntity(id, gen uint32) ecs.Entity {
+	entity := ecs.Entity{}
+	_ = entity.UnmarshalJSON(fmt.Appendf(nil, "[%d,%d]", id, gen))
+	return entity
+}
+
+type entityCmd struct {
+	Entity string `positional:"" help:"Entity as <id>[.<gen>]. The option name can be omitted."`
+}
+
+// entityInfo is the structured result of the entity command.
+type entityInfo struct {
+	Entity       ecs.Entity            `json:"entity"`
+	Archetype    []string              `json:"archetype"`
+	Components   map[string]any        `json:"components"`
+	Relations    map[string]ecs.Entity `json:"relations"`
+	ReferencedBy []entityReference     `json:"referencedBy"`
+}
+
+// entityReference is an entity that references another entity by a relation.
+type entityReference struct {
+	Entity   ecs.Entity `json:"entity"`
+	Relation string     `json:"relation"`
+}
+
+func (c entityCmd) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.Entity == "" {
+		return nil, errors.New("no entity given; use entity <id>[.<gen>]")
+	}
+	entity, err := resolveEntity(world, c.Entity)
+	if err != nil {
+		return nil, err
+	}
+
+	u := world.Unsafe()
+	ids := u.IDs(entity)
+	result := entityInfo{
+		Entity:       entity,
+		Archetype:    []string{},
+		Components:   map[string]any{},
+		Relations:    map[string]ecs.Entity{},
+		ReferencedBy: []entityReference{},
+	}
+
+	fmt.Fprintf(out, "Entity %v (alive)\n", entity)
+	components := strings.Builder{}
+	relations := strings.Builder{}
+	for i := range ids.Len() {
+		id := ids.Get(i)
+		info, _ := ecs.ComponentInfo(world, id)
+		name := info.Type.Name()
+		result.Archetype = append(result.Archetype, name)
+
+		value := reflect.NewAt(info.Type, u.Get(entity, id)).Elem()
+		result.Components[name] = value.Interface()
+		writePretty(&components, 1, name, value)
+
+		if info.IsRelation {
+			target := u.GetRelation(entity, id)
+			result.Relations[name] = target
+			fmt.Fprintf(&relations, "  %s -> %v\n", name, target)
+		}
+	}
+	fmt.Fprintf(out, "Archetype: [%s]\n", strings.Join(result.Archetype, " "))
+	if components.Len() > 0 {
+		fmt.Fprintf(out, "Components:\n%s", components.String())
+	}
+	if relations.Len() > 0 {
+		fmt.Fprintf(out, "Relations:\n%s", relations.String())
+	}
+
+	result.ReferencedBy = referencingEntities(world, entity)
+	if len(result.ReferencedBy) > 0 {
+		fmt.Fprintln(out, "Referenced by:")
+		for _, ref := range result.ReferencedBy {
+			fmt.Fprintf(out, "  %v (%s)\n", ref.Entity, ref.Relation)
+		}
+	}
+	return result, nil
+}
+
+func (c entityCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Inspect a single entity, like 'entity 5' or 'entity 5.0'.")
+	fmt.Fprintln(out, "Shows its archetype, components, relation targets and entities referencing it by relations.")
+}
+
+// referencingEntities returns all entities that have the given entity as relation target.
+func referencingEntities(world *ecs.World, target ecs.Entity) []entityReference {
+	refs := []entityReference{}
+	for _, id := range ecs.ComponentIDs(world) {
+		info, _ := ecs.ComponentInfo(world, id)
+		if !info.IsRelation {
+			continue
+		}
+		query := ecs.NewUnsafeFilter(world, id).Query(ecs.RelID(id, target))
+		for query.Next() {
+			refs = append(refs, entityReference{Entity: query.Entity(), Relation: info.Type.Name()})
+		}
+	}
+	return refs
+}
+
+// writePretty writes a value with indentation, with one line per struct field.
+func writePretty(out io.Writer, indent int, name string, value reflect.Value) {
+	prefix := strings.Repeat("  ", indent)
+	if value.Kind() != reflect.Struct || value.Type() == entityType || value.NumField() == 0 {
+		fmt.Fprintf(out, "%s%s: %+v\n", prefix, name, value)
+		return
+	}
+	fmt.Fprintf(out, "%s%s:\n", prefix, name)
+	for i := range value.NumField() {
+		if value.Type().Field(i).Type == relationMarkerType {
+			continue
+		}
+		writePretty(out, indent+1, value.Type().Field(i).Name, value.Field(i))
+	}
+}
@@ -0,0 +1,375 @@
+package repl
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// filterExpr is a compiled filter expression, like "Position.X > 50 && Velocity.Y != 0".
+//
+// Grammar:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = field | number | string | "true" | "false"
+//
+// Fields are component fields like "Position.X", see [resolveField].
+// Strings are enclosed in single or double quotes.
+// Numbers of all types are compared as float64.
+// Operands without comparison must be boolean.
+type filterExpr struct {
+	eval  func(get getter) bool
+	comps []ecs.ID
+}
+
+// compileExpr parses and type-checks a filter expression.
+func compileExpr(world *ecs.World, src string) (*filterExpr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := exprParser{world: world, tokens: tokens}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected '%s'", tok.text)
+	}
+	return &filterExpr{eval: eval, comps: p.comps}, nil
+}
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-"}
+
+// lexExpr splits a filter expression into tokens.
+func lexExpr(src string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	runes := []rune(src)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, exprToken{tokLParen, "(", start})
+			i++
+		case r == ')':
+			tokens = append(tokens, exprToken{tokRParen, ")", start})
+			i++
+		case r == '"' || r == '\'':
+			i++
+			for i < len(runes) && runes[i] != r {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("invalid filter: unterminated string at position %d", start+1)
+			}
+			tokens = append(tokens, exprToken{tokString, string(runes[start+1 : i]), start})
+			i++
+		case unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokIdent, string(runes[start:i]), start})
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("invalid filter: unexpected character '%c' at position %d", r, start+1)
+			}
+			tokens = append(tokens, exprToken{tokOp, op, start})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "end of expression", len(runes)}), nil
+}
+
+type valueKind uint8
+
+const (
+	kindNumber valueKind = iota
+	kindString
+	kindBool
+)
+
+func (k valueKind) String() string {
+	return [...]string{"number", "string", "bool"}[k]
+}
+
+// operand of a comparison, either a field or a literal.
+type operand struct {
+	text  string
+	kind  valueKind
+	field *fieldPath
+	num   float64
+	str   string
+	bool  bool
+}
+
+func (o *operand) number(get getter) float64 {
+	if o.field == nil {
+		return o.num
+	}
+	return numberValue(o.field.value(get))
+}
+
+func (o *operand) string(get getter) string {
+	if o.field == nil {
+		return o.str
+	}
+	return o.field.value(get).String()
+}
+
+func (o *operand) boolean(get getter) bool {
+	if o.field == nil {
+		return o.bool
+	}
+	return o.field.value(get).Bool()
+}
+
+type exprParser struct {
+	world  *ecs.World
+	tokens []exprToken
+	pos    int
+	comps  []ecs.ID
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...any) error {
+	return fmt.Errorf("invalid filter: %s at position %d", fmt.Sprintf(format, args...), tok.pos+1)
+}
+
+func (p *exprParser) parseOr() (func(get getter) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(get getter) bool { return l(get) || right(get) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (func(get getter) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(get getter) bool { return l(get) && right(get) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (func(get getter) bool, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && tok.text == "!" {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(get getter) bool { return !inner(get) }, nil
+	}
+	if tok.kind == tokLParen {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, p.errorf(tok, "expected ')' but got '%s'", tok.text)
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (func(get getter) bool, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp || !slices.Contains([]string{"==", "!=", "<", "<=", ">", ">="}, tok.text) {
+		if left.kind != kindBool {
+			return nil, p.errorf(tok, "expected comparison after %s '%s'", left.kind, left.text)
+		}
+		return left.boolean, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if left.kind != right.kind {
+		return nil, p.errorf(tok, "cannot compare %s '%s' with %s '%s'", left.kind, left.text, right.kind, right.text)
+	}
+
+	op := tok.text
+	switch left.kind {
+	case kindNumber:
+		cmp := compareFunc[float64](op)
+		return func(get getter) bool { return cmp(left.number(get), right.number(get)) }, nil
+	case kindString:
+		cmp := compareFunc[string](op)
+		return func(get getter) bool { return cmp(left.string(get), right.string(get)) }, nil
+	default:
+		if op != "==" && op != "!=" {
+			return nil, p.errorf(tok, "operator '%s' is not supported for bools", op)
+		}
+		eq := op == "=="
+		return func(get getter) bool { return (left.boolean(get) == right.boolean(get)) == eq }, nil
+	}
+}
+
+func (p *exprParser) parseOperand() (*operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &operand{text: tok.text, kind: kindString, str: tok.text}, nil
+	case tokNumber:
+		return p.parseNumber(tok, tok.text)
+	case tokOp:
+		if tok.text == "-" && p.peek().kind == tokNumber {
+			return p.parseNumber(tok, "-"+p.next().text)
+		}
+	case tokIdent:
+		if tok.text == "true" || tok.text == "false" {
+			return &operand{text: tok.text, kind: kindBool, bool: tok.text == "true"}, nil
+		}
+		field, err := resolveField(p.world, tok.text)
+		if err != nil {
+			return nil, p.errorf(tok, "%s", err.Error())
+		}
+		kind, ok := fieldKind(field.typ)
+		if !ok {
+			return nil, p.errorf(tok, "field '%s' of type %s can't be compared; only numbers, strings and bools are supported", tok.text, field.typ)
+		}
+		if !slices.Contains(p.comps, field.comp) {
+			p.comps = append(p.comps, field.comp)
+		}
+		return &operand{text: tok.text, kind: kind, field: &field}, nil
+	}
+	return nil, p.errorf(tok, "expected field or value but got '%s'", tok.text)
+}
+
+func (p *exprParser) parseNumber(tok exprToken, text string) (*operand, error) {
+	num, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.errorf(tok, "invalid number '%s'", text)
+	}
+	return &operand{text: text, kind: kindNumber, num: num}, nil
+}
+
+// numberValue converts a numeric value to float64.
+// Bools are converted to 0 or 1.
+func numberValue(v reflect.Value) float64 {
+	switch {
+	case v.CanInt():
+		return float64(v.Int())
+	case v.CanUint():
+		return float64(v.Uint())
+	case v.CanFloat():
+		return v.Float()
+	case v.Kind() == reflect.Bool && v.Bool():
+		return 1
+	}
+	return 0
+}
+
+// fieldKind returns the kind of values of a field type, and whether it is supported.
+func fieldKind(tp reflect.Type) (valueKind, bool) {
+	switch tp.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return kindNumber, true
+	case reflect.String:
+		return kindString, true
+	case reflect.Bool:
+		return kindBool, true
+	}
+	return 0, false
+}
+
+// compareFunc returns a function for a comparison operator.
+func compareFunc[T float64 | string](op string) func(a, b T) bool {
+	switch op {
+	case "==":
+		return func(a, b T) bool { return a == b }
+	case "!=":
+		return func(a, b T) bool { return a != b }
+	case "<":
+		return func(a, b T) bool { return a < b }
+	case "<=":
+		return func(a, b T) bool { return a <= b }
+	case ">":
+		return func(a, b T) bool { return a > b }
+	default:
+		return func(a, b T) bool { return a >= b }
+	}
+}
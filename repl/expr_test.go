@@ -0,0 +1,89 @@
+package repl
+
+import (
+	"testing"
+
+	"github.com/mlange-42/ark/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+type exprHeading struct {
+	Angle float32
+}
+
+type exprAgent struct {
+	Name    string
+	Active  bool
+	Count   uint16
+	Heading exprHeading
+}
+
+func TestCompileExpr(t *testing.T) {
+	world := ecs.NewWorld()
+	ecs.NewMap2[position, exprAgent](&world).NewEntity(
+		&position{X: 60, Y: -2},
+		&exprAgent{Name: "bob", Active: true, Count: 3, Heading: exprHeading{Angle: 1.5}},
+	)
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"position.X > 50", true},
+		{"repl.position.X > 50 && position.Y != 0", true},
+		{"position.X < 50 || position.Y == -2", true},
+		{"!(position.X >= 60)", false},
+		{"position.Y <= -2.5e0", false},
+		{"exprAgent.Name == 'bob'", true},
+		{`exprAgent.Name < "alice"`, false},
+		{"exprAgent.Active", true},
+		{"!exprAgent.Active || exprAgent.Count == 3", true},
+		{"exprAgent.Active == false", false},
+		{"exprAgent.Heading.Angle > 1 && exprAgent.Heading.Angle < 2", true},
+		{"true", true},
+	}
+
+	query := ecs.NewUnsafeFilter(&world).Query()
+	assert.True(t, query.Next())
+	for _, tt := range tests {
+		expr, err := compileExpr(&world, tt.expr)
+		if !assert.Nil(t, err, tt.expr) {
+			continue
+		}
+		assert.Equal(t, tt.match, expr.eval(query.Get), tt.expr)
+	}
+	query.Close()
+
+	expr, err := compileExpr(&world, "position.X > 0 && exprAgent.Count > 0 && position.Y < 0")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(expr.comps))
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	world := ecs.NewWorld()
+	ecs.NewMap2[position, exprAgent](&world).NewEntity(&position{}, &exprAgent{})
+
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"position.X >", "invalid filter: expected field or value but got 'end of expression' at position 13"},
+		{"position.X > 'a'", "invalid filter: cannot compare number 'position.X' with string 'a' at position 12"},
+		{"position.X", "invalid filter: expected comparison after number 'position.X' at position 11"},
+		{"(position.X > 1", "invalid filter: expected ')' but got 'end of expression' at position 16"},
+		{"position.Z > 1", "invalid filter: position.Z: type repl.position has no exported field 'Z'; available: X, Y at position 1"},
+		{"velocity.X > 1", "invalid filter: unknown component type in 'velocity.X' at position 1"},
+		{"exprAgent.Heading > 1", "invalid filter: field 'exprAgent.Heading' of type repl.exprHeading can't be compared; only numbers, strings and bools are supported at position 1"},
+		{"exprAgent.Active > true", "invalid filter: operator '>' is not supported for bools at position 18"},
+		{"exprAgent.Name == 'bob", "invalid filter: unterminated string at position 19"},
+		{"position.X > 1 position.Y", "invalid filter: unexpected 'position.Y' at position 16"},
+		{"position.X # 1", "invalid filter: unexpected character '#' at position 12"},
+	}
+
+	for _, tt := range tests {
+		_, err := compileExpr(&world, tt.expr)
+		if assert.NotNil(t, err, tt.expr) {
+			assert.Equal(t, tt.err, err.Error(), tt.expr)
+		}
+	}
+}
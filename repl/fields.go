@@ -0,0 +1,191 @@
+package repl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// getter returns a pointer to a component of the current entity, like [ecs.UnsafeQuery.Get].
+type getter func(id ecs.ID) unsafe.Pointer
+
+// fieldPath references a component or one of its (nested) fields, like "Position.X".
+type fieldPath struct {
+	name     string
+	comp     ecs.ID
+	compType reflect.Type
+	index    []int
+	typ      reflect.Type
+}
+
+// resolveField resolves a field path.
+//
+// The path starts with a component type, either with package ("main.Position")
+// or, if unambiguous, without ("Position"). It is followed by any number of field names.
+func resolveField(world *ecs.World, path string) (fieldPath, error) {
+	var candidates []fieldPath
+	for _, id := range ecs.ComponentIDs(world) {
+		info, _ := ecs.ComponentInfo(world, id)
+		for _, name := range []string{info.Type.String(), info.Type.Name()} {
+			rest, ok := strings.CutPrefix(path, name)
+			if !ok || (rest != "" && rest[0] != '.') {
+				continue
+			}
+			candidates = append(candidates, fieldPath{name: path, comp: id, compType: info.Type, typ: info.Type})
+			if rest != "" {
+				fields, err := resolveNested(info.Type, rest[1:])
+				if err != nil {
+					return fieldPath{}, fmt.Errorf("%s: %w", path, err)
+				}
+				last := &candidates[len(candidates)-1]
+				last.index = fields.index
+				last.typ = fields.typ
+			}
+			break
+		}
+	}
+
+	if len(candidates) == 0 {
+		return fieldPath{}, fmt.Errorf("unknown component type in '%s'", path)
+	}
+	if len(candidates) > 1 {
+		names := make([]string, len(candidates))
+		for i, c := range candidates {
+			names[i] = c.compType.String()
+		}
+		return fieldPath{}, fmt.Errorf("ambiguous component type in '%s'; candidates: %s", path, strings.Join(names, ", "))
+	}
+	return candidates[0], nil
+}
+
+// resolveNested resolves a dot-separated path of nested struct fields.
+func resolveNested(tp reflect.Type, path string) (fieldPath, error) {
+	f := fieldPath{typ: tp}
+	for _, name := range strings.Split(path, ".") {
+		if f.typ.Kind() != reflect.Struct {
+			return fieldPath{}, fmt.Errorf("type %s has no field '%s'", f.typ, name)
+		}
+		field, ok := f.typ.FieldByName(name)
+		if !ok || !field.IsExported() {
+			return fieldPath{}, fmt.Errorf("type %s has no exported field '%s'; available: %s", f.typ, name, strings.Join(exportedFields(f.typ), ", "))
+		}
+		f.index = append(f.index, field.Index...)
+		f.typ = field.Type
+	}
+	return f, nil
+}
+
+// exportedFields returns the names of the exported fields of a struct type.
+func exportedFields(tp reflect.Type) []string {
+	names := []string{}
+	for i := range tp.NumField() {
+		if field := tp.Field(i); field.IsExported() {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// value returns the referenced value of the current entity.
+func (f *fieldPath) value(get getter) reflect.Value {
+	return reflect.NewAt(f.compType, get(f.comp)).Elem().FieldByIndex(f.index)
+}
+
+// resolveFieldList resolves a list of field paths.
+func resolveFieldList(world *ecs.World, paths []string) ([]fieldPath, error) {
+	fields := make([]fieldPath, 0, len(paths))
+	for _, path := range paths {
+		field, err := resolveField(world, path)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// parseValue converts a string to a value of the given type, following the rules for command options.
+// Entities are given as <id>[.<gen>] and must be alive.
+func parseValue(world *ecs.World, tp reflect.Type, name string, raw string) (reflect.Value, error) {
+	value := reflect.New(tp).Elem()
+	if tp == entityType {
+		entity, err := resolveEntity(world, raw)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid value for entity field '%s': %w", name, err)
+		}
+		value.Set(reflect.ValueOf(entity))
+		return value, nil
+	}
+
+	var err error
+	switch tp.Kind() {
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(raw); err == nil {
+			value.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var v int64
+		if v, err = strconv.ParseInt(raw, 10, tp.Bits()); err == nil {
+			value.SetInt(v)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var v uint64
+		if v, err = strconv.ParseUint(raw, 10, tp.Bits()); err == nil {
+			value.SetUint(v)
+		}
+	case reflect.Float32, reflect.Float64:
+		var v float64
+		if v, err = strconv.ParseFloat(raw, tp.Bits()); err == nil {
+			value.SetFloat(v)
+		}
+	case reflect.String:
+		value.SetString(raw)
+	default:
+		return reflect.Value{}, fmt.Errorf("can't set '%s' of type %s; only numbers, strings, bools and entities are supported", name, tp)
+	}
+	if err != nil {
+		kind, _ := fieldKind(tp)
+		return reflect.Value{}, fmt.Errorf("invalid value for %s field '%s': %s", kind, name, raw)
+	}
+	return value, nil
+}
+
+// assignment of a value to a field.
+type assignment struct {
+	field fieldPath
+	value reflect.Value
+}
+
+// parseAssignments parses field assignments like "Position.X=10".
+func parseAssignments(world *ecs.World, args []string) ([]assignment, error) {
+	assignments := make([]assignment, 0, len(args))
+	for _, arg := range args {
+		path, raw, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid assignment '%s'; expected <Component.Field>=<value>", arg)
+		}
+		field, err := resolveField(world, path)
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseValue(world, field.typ, path, raw)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment{field: field, value: value})
+	}
+	return assignments, nil
+}
+
+// assign sets the assigned fields of the current entity.
+func assign(assignments []assignment, get getter) {
+	for i := range assignments {
+		a := &assignments[i]
+		a.field.value(get).Set(a.value)
+	}
+}
@@ -0,0 +1,421 @@
+package repl
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goccy/go-json"
+	"gopkg.in/yaml.v3"
+)
+
+// format for command output.
+type format string
+
+// Output formats.
+const (
+	// formatText is the human-readable output of the command itself.
+	formatText  format = "text"
+	formatTable format = "table"
+	formatJSON  format = "json"
+	formatCSV   format = "csv"
+	formatYAML  format = "yaml"
+)
+
+var formats = []format{formatText, formatTable, formatJSON, formatCSV, formatYAML}
+
+const (
+	// formatOption is the option to select the output format of a single command.
+	formatOption = "format="
+	// formatCommand is the command to show or set the default format of a session.
+	formatCommand = "format"
+)
+
+// settings of a front-end session.
+type settings struct {
+	format format
+	// interrupt waits for the user to stop a streaming command, until done is closed.
+	// Returns false if done was closed first.
+	// If nil, streaming commands can only be stopped by canceling their context.
+	interrupt func(done <-chan struct{}) bool
+	// stopHint tells the user how to stop a streaming command.
+	stopHint string
+}
+
+// newSettings creates settings with defaults.
+func newSettings() *settings {
+	return &settings{format: formatText, stopHint: "cancel with Ctrl+C"}
+}
+
+// interruptible derives a context for a streaming command
+// that is canceled with [ErrCanceled] when the user stops the command.
+// The returned function must be called when the command has finished.
+func (s *settings) interruptible(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if s.interrupt == nil {
+		return ctx, func() { cancel(nil) }
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if s.interrupt(done) {
+			cancel(ErrCanceled)
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		// Wait, so that the session can read input again.
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// setFormat handles the format command with the given arguments.
+func (s *settings) setFormat(args []string, out io.Writer) error {
+	switch len(args) {
+	case 0:
+		_, err := fmt.Fprintf(out, "Output format: %s\n", s.format)
+		return err
+	case 1:
+		f, err := parseFormat(args[0])
+		if err != nil {
+			return err
+		}
+		s.format = f
+		_, err = fmt.Fprintf(out, "Output format set to %s\n", f)
+		return err
+	}
+	return fmt.Errorf("usage: %s [%s]", formatCommand, strings.Join(formatNames(), "|"))
+}
+
+// formatNames returns the names of all formats.
+func formatNames() []string {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = string(f)
+	}
+	return names
+}
+
+// parseFormat parses the name of an output format.
+func parseFormat(name string) (format, error) {
+	for _, f := range formats {
+		if string(f) == strings.ToLower(name) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown format '%s'; available formats: %s", name, strings.Join(formatNames(), ", "))
+}
+
+// extractFormat removes a format option from the arguments of a command line.
+// Returns the remaining arguments and the format, or the given default if there is no format option.
+func extractFormat(tokens []string, def format) ([]string, format, error) {
+	f := def
+	rest := tokens[:0]
+	for _, token := range tokens {
+		if value, ok := strings.CutPrefix(token, formatOption); ok && len(rest) > 0 {
+			var err error
+			if f, err = parseFormat(value); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		rest = append(rest, token)
+	}
+	return rest, f, nil
+}
+
+// tabler is implemented by results that should be rendered as tables
+// from a different value than the result itself.
+type tabler interface {
+	tableData() any
+}
+
+// snapshot of a command's result, encoded during execution.
+// Results may reference world data, so they can't be used after the command has finished.
+type snapshot struct {
+	data  json.RawMessage
+	table json.RawMessage
+}
+
+// takeSnapshot encodes a result.
+func takeSnapshot(result any) (*snapshot, error) {
+	if result == nil {
+		return nil, nil
+	}
+	data, err := marshalJSON(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode result: %w", err)
+	}
+	s := snapshot{data: data, table: data}
+	if t, ok := result.(tabler); ok {
+		if s.table, err = marshalJSON(t.tableData()); err != nil {
+			return nil, fmt.Errorf("failed to encode result: %w", err)
+		}
+	}
+	return &s, nil
+}
+
+// render writes a result in the given format.
+func render(f format, s *snapshot, out io.Writer) error {
+	switch f {
+	case formatJSON:
+		buf := bytes.Buffer{}
+		if err := json.Indent(&buf, s.data, "", "  "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := out.Write(buf.Bytes())
+		return err
+	case formatYAML:
+		root, err := decodeNode(s.data)
+		if err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(out)
+		enc.SetIndent(2)
+		if err := enc.Encode(root.yaml()); err != nil {
+			return err
+		}
+		return enc.Close()
+	case formatTable, formatCSV:
+		root, err := decodeNode(s.table)
+		if err != nil {
+			return err
+		}
+		header, rows := root.rows()
+		if f == formatCSV {
+			return writeCSV(out, header, rows)
+		}
+		return writeTable(out, header, rows)
+	}
+	return fmt.Errorf("unsupported format '%s'", f)
+}
+
+func writeCSV(out io.Writer, header []string, rows [][]string) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+func writeTable(out io.Writer, header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+type nodeKind uint8
+
+const (
+	nodeNull nodeKind = iota
+	nodeBool
+	nodeNumber
+	nodeString
+	nodeArray
+	nodeObject
+)
+
+// node of a decoded JSON value.
+// Unlike decoding into maps, it preserves the order of object keys.
+type node struct {
+	kind   nodeKind
+	value  string
+	items  []node
+	keys   []string
+	values []node
+}
+
+// decodeNode decodes JSON into a tree of nodes.
+func decodeNode(data []byte) (node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeValue(dec)
+}
+
+func decodeValue(dec *json.Decoder) (node, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return node{}, err
+	}
+	switch t := token.(type) {
+	case nil:
+		return node{kind: nodeNull, value: "null"}, nil
+	case bool:
+		return node{kind: nodeBool, value: fmt.Sprint(t)}, nil
+	case json.Number:
+		return node{kind: nodeNumber, value: t.String()}, nil
+	case string:
+		return node{kind: nodeString, value: t}, nil
+	case json.Delim:
+		n := node{kind: nodeArray}
+		if t == '{' {
+			n.kind = nodeObject
+		}
+		for dec.More() {
+			if n.kind == nodeObject {
+				key, err := dec.Token()
+				if err != nil {
+					return node{}, err
+				}
+				n.keys = append(n.keys, fmt.Sprint(key))
+			}
+			value, err := decodeValue(dec)
+			if err != nil {
+				return node{}, err
+			}
+			if n.kind == nodeObject {
+				n.values = append(n.values, value)
+			} else {
+				n.items = append(n.items, value)
+			}
+		}
+		// Consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return node{}, err
+		}
+		return n, nil
+	}
+	return node{}, fmt.Errorf("unexpected JSON token %v", token)
+}
+
+// yaml converts the node to a YAML node.
+func (n *node) yaml() *yaml.Node {
+	switch n.kind {
+	case nodeArray:
+		y := yaml.Node{Kind: yaml.SequenceNode}
+		if len(n.items) == 0 {
+			y.Style = yaml.FlowStyle
+		}
+		for i := range n.items {
+			y.Content = append(y.Content, n.items[i].yaml())
+		}
+		return &y
+	case nodeObject:
+		y := yaml.Node{Kind: yaml.MappingNode}
+		if len(n.keys) == 0 {
+			y.Style = yaml.FlowStyle
+		}
+		for i, key := range n.keys {
+			y.Content = append(y.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, n.values[i].yaml())
+		}
+		return &y
+	case nodeNull:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	case nodeBool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: n.value}
+	case nodeNumber:
+		tag := "!!int"
+		if strings.ContainsAny(n.value, ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: n.value}
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: n.value}
+	}
+}
+
+// rows converts the node to table rows.
+//
+// Arrays result in a row per element, with nested objects flattened into columns.
+// Objects result in a row per flattened key, with columns "key" and "value".
+// Scalars result in a single cell.
+func (n *node) rows() (header []string, rows [][]string) {
+	switch n.kind {
+	case nodeArray:
+		columns := map[string]int{}
+		cells := make([]map[string]string, len(n.items))
+		for i := range n.items {
+			cells[i] = map[string]string{}
+			n.items[i].flatten("", func(key, value string) {
+				if _, ok := columns[key]; !ok {
+					columns[key] = len(header)
+					header = append(header, key)
+				}
+				cells[i][key] = value
+			})
+		}
+		for _, c := range cells {
+			row := make([]string, len(header))
+			for j, key := range header {
+				row[j] = c[key]
+			}
+			rows = append(rows, row)
+		}
+		return header, rows
+	case nodeObject:
+		n.flatten("", func(key, value string) {
+			rows = append(rows, []string{key, value})
+		})
+		return []string{"key", "value"}, rows
+	default:
+		return []string{"value"}, [][]string{{n.cell()}}
+	}
+}
+
+// flatten calls fn for all scalar values and arrays of an object, with keys joined by ".".
+// For other nodes, fn is called with the key "value".
+func (n *node) flatten(prefix string, fn func(key, value string)) {
+	if n.kind != nodeObject {
+		if prefix == "" {
+			prefix = "value"
+		}
+		fn(prefix, n.cell())
+		return
+	}
+	for i, key := range n.keys {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		n.values[i].flatten(key, fn)
+	}
+}
+
+// cell formats the node for a table cell.
+func (n *node) cell() string {
+	switch n.kind {
+	case nodeNull:
+		return ""
+	case nodeArray, nodeObject:
+		return n.compact()
+	default:
+		return n.value
+	}
+}
+
+// compact formats the node as compact JSON.
+func (n *node) compact() string {
+	switch n.kind {
+	case nodeString:
+		enc, _ := json.Marshal(n.value)
+		return string(enc)
+	case nodeArray:
+		parts := make([]string, len(n.items))
+		for i := range n.items {
+			parts[i] = n.items[i].compact()
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case nodeObject:
+		parts := make([]string, len(n.keys))
+		for i, key := range n.keys {
+			enc, _ := json.Marshal(key)
+			parts[i] = string(enc) + ":" + n.values[i].compact()
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	default:
+		return n.value
+	}
+}
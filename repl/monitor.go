@@ -1,6 +1,7 @@
 package repl
 
 import (
+	"context"
 	"strings"
 
 	"github.com/goccy/go-json"
@@ -9,13 +10,18 @@ import (
 
 type localConnection struct {
 	repl *Repl
+	ctx  context.Context
 }
 
 func (s *localConnection) Get() (monitor.Stats, error) {
 	out := strings.Builder{}
-	s.repl.execCommand(getStats{s.repl}, &out)
-
 	st := monitor.Stats{}
+	ctx, cancel := s.repl.withTimeout(s.ctx, 0)
+	defer cancel()
+	if _, err := s.repl.execCommand(ctx, getStats{s.repl}, false, &out); err != nil {
+		return st, err
+	}
+
 	if err := json.Unmarshal([]byte(out.String()), &st); err != nil {
 		return st, err
 	}
@@ -25,6 +31,8 @@ func (s *localConnection) Get() (monitor.Stats, error) {
 func (s *localConnection) Exec(cmd string) error {
 	out := strings.Builder{}
 	command := s.repl.commands[cmd]
-	s.repl.execCommand(command.command, &out)
-	return nil
+	ctx, cancel := s.repl.withTimeout(s.ctx, 0)
+	defer cancel()
+	_, err := s.repl.execCommand(ctx, command.command, false, &out)
+	return err
 }
@@ -0,0 +1,399 @@
+package repl
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// Encodings of non-finite floats, which JSON has no numbers for.
+const (
+	jsonNaN    = "NaN"
+	jsonPosInf = "+Inf"
+	jsonNegInf = "-Inf"
+)
+
+var (
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// marshalJSON encodes a value like [json.Marshal],
+// but encodes non-finite floats as the strings "NaN", "+Inf" and "-Inf" instead of failing.
+// Types with their own MarshalJSON method are encoded by it.
+func marshalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	var unsupported *json.UnsupportedValueError
+	if !errors.As(err, &unsupported) {
+		return data, err
+	}
+	buf := bytes.Buffer{}
+	if err := encodeNonFinite(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalJSON decodes a value like [json.Unmarshal],
+// but also accepts the strings written by [marshalJSON] for non-finite floats.
+func unmarshalJSON(data []byte, v any) error {
+	err := json.Unmarshal(data, v)
+	if err == nil || !bytes.Contains(data, []byte(jsonNaN)) && !bytes.Contains(data, []byte("Inf\"")) {
+		return err
+	}
+	var node any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if dec.Decode(&node) != nil {
+		return err
+	}
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return err
+	}
+	return decodeNonFinite(value.Elem(), node)
+}
+
+// hasFloats returns whether values of a type may contain floats that need special encoding.
+// Types with their own JSON methods are handled by them.
+func hasFloats(tp reflect.Type, visited map[reflect.Type]bool) bool {
+	if tp.Implements(jsonMarshalerType) || reflect.PointerTo(tp).Implements(jsonUnmarshalerType) {
+		return false
+	}
+	if done, ok := visited[tp]; ok {
+		return done
+	}
+	visited[tp] = false
+	result := false
+	switch tp.Kind() {
+	case reflect.Float32, reflect.Float64, reflect.Interface:
+		result = true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		result = hasFloats(tp.Elem(), visited)
+	case reflect.Struct:
+		for _, f := range jsonFields(tp) {
+			if hasFloats(tp.FieldByIndex(f.index).Type, visited) {
+				result = true
+				break
+			}
+		}
+	}
+	visited[tp] = result
+	return result
+}
+
+// jsonField is a struct field as encoded to JSON.
+type jsonField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// jsonFields returns the fields of a struct type that are encoded to JSON, following the json tags.
+// Embedded structs without a name in the tag are inlined.
+func jsonFields(tp reflect.Type) []jsonField {
+	fields := []jsonField{}
+	for i := range tp.NumField() {
+		f := tp.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, inner := range jsonFields(f.Type) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, index: f.Index, omitEmpty: slices.Contains(strings.Split(opts, ","), "omitempty")})
+	}
+	return fields
+}
+
+// encodeNonFinite encodes a value, with non-finite floats as strings.
+// Parts without floats are encoded by [json.Marshal].
+func encodeNonFinite(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteString("null")
+		return nil
+	}
+	if !v.CanInterface() {
+		return fmt.Errorf("can't encode %s in unexported embedded struct", v.Type())
+	}
+	if !hasFloats(v.Type(), map[reflect.Type]bool{}) {
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		switch {
+		case math.IsNaN(f):
+			buf.WriteString(strconv.Quote(jsonNaN))
+		case math.IsInf(f, 1):
+			buf.WriteString(strconv.Quote(jsonPosInf))
+		case math.IsInf(f, -1):
+			buf.WriteString(strconv.Quote(jsonNegInf))
+		default:
+			data, err := json.Marshal(v.Interface())
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return encodeNonFinite(buf, v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i := range v.Len() {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeNonFinite(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		keys := make([]string, 0, v.Len())
+		values := map[string]reflect.Value{}
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := mapKey(iter.Key())
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			values[key] = iter.Value()
+		}
+		slices.Sort(keys)
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(strconv.Quote(key))
+			buf.WriteByte(':')
+			if err := encodeNonFinite(buf, values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case reflect.Struct:
+		buf.WriteByte('{')
+		first := true
+		for _, f := range jsonFields(v.Type()) {
+			field := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyJSON(field) {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			buf.WriteString(strconv.Quote(f.name))
+			buf.WriteByte(':')
+			if err := encodeNonFinite(buf, field); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return &json.UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+// isEmptyJSON returns whether a value is omitted by the omitempty option.
+func isEmptyJSON(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// mapKey returns the JSON object key for a map key.
+func mapKey(key reflect.Value) (string, error) {
+	if key.Type().Implements(textMarshalerType) {
+		text, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", &json.UnsupportedTypeError{Type: key.Type()}
+}
+
+// decodeNonFinite decodes a generic JSON value into v,
+// accepting the strings for non-finite floats where floats are expected.
+// Parts without floats are decoded by [json.Unmarshal].
+func decodeNonFinite(v reflect.Value, node any) error {
+	tp := v.Type()
+	if !v.CanSet() {
+		return fmt.Errorf("can't decode %s in unexported embedded struct", tp)
+	}
+	decodeDefault := func() error {
+		data, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+	if !hasFloats(tp, map[reflect.Type]bool{}) || node == nil {
+		return decodeDefault()
+	}
+
+	switch tp.Kind() {
+	case reflect.Float32, reflect.Float64:
+		str, ok := node.(string)
+		if !ok {
+			return decodeDefault()
+		}
+		switch str {
+		case jsonNaN:
+			v.SetFloat(math.NaN())
+		case jsonPosInf, "Inf":
+			v.SetFloat(math.Inf(1))
+		case jsonNegInf:
+			v.SetFloat(math.Inf(-1))
+		default:
+			return fmt.Errorf("invalid number %q for %s", str, tp)
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(tp.Elem()))
+		}
+		return decodeNonFinite(v.Elem(), node)
+	case reflect.Slice, reflect.Array:
+		values, ok := node.([]any)
+		if !ok {
+			return decodeDefault()
+		}
+		if tp.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(tp, len(values), len(values)))
+		}
+		for i, value := range values {
+			if i >= v.Len() {
+				break
+			}
+			if err := decodeNonFinite(v.Index(i), value); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		values, ok := node.(map[string]any)
+		if !ok {
+			return decodeDefault()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(tp))
+		}
+		for key, value := range values {
+			k, err := decodeMapKey(tp.Key(), key)
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(tp.Elem()).Elem()
+			if err := decodeNonFinite(elem, value); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, elem)
+		}
+	case reflect.Struct:
+		values, ok := node.(map[string]any)
+		if !ok {
+			return decodeDefault()
+		}
+		for _, f := range jsonFields(tp) {
+			value, ok := values[f.name]
+			if !ok {
+				for key, val := range values {
+					if strings.EqualFold(key, f.name) {
+						value, ok = val, true
+						break
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+			if err := decodeNonFinite(v.FieldByIndex(f.index), value); err != nil {
+				return err
+			}
+		}
+	default:
+		return decodeDefault()
+	}
+	return nil
+}
+
+// decodeMapKey decodes a JSON object key into a map key of the given type.
+func decodeMapKey(tp reflect.Type, key string) (reflect.Value, error) {
+	k := reflect.New(tp)
+	if reflect.PointerTo(tp).Implements(textUnmarshalerType) {
+		err := k.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key))
+		return k.Elem(), err
+	}
+	switch tp.Kind() {
+	case reflect.String:
+		k.Elem().SetString(key)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, tp.Bits())
+		if err != nil {
+			return k.Elem(), err
+		}
+		k.Elem().SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(key, 10, tp.Bits())
+		if err != nil {
+			return k.Elem(), err
+		}
+		k.Elem().SetUint(n)
+	default:
+		return k.Elem(), &json.UnsupportedTypeError{Type: tp}
+	}
+	return k.Elem(), nil
+}
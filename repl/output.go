@@ -0,0 +1,152 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrOutputLimit is returned for commands that exceeded the output limit.
+var ErrOutputLimit = errors.New("repl: output limit exceeded")
+
+const (
+	// defaultOutputLimit is the default maximum output size per command, in bytes.
+	defaultOutputLimit = 16 << 20
+	// chunkSize is the size of output chunks forwarded to clients, in bytes.
+	chunkSize = 32 << 10
+	// streamBuffer is the number of chunks buffered for a slow client.
+	streamBuffer = 4
+)
+
+// output is the writer commands write to.
+//
+// Output is forwarded to a sink in chunks while the command is executing,
+// so large outputs are not accumulated in memory.
+// Writes beyond the limit are discarded and fail with [ErrOutputLimit].
+type output struct {
+	sink    func([]byte) error
+	buf     []byte
+	written int
+	limit   int
+	err     error
+}
+
+// newOutput creates an output with the REPL's output limit.
+func (r *Repl) newOutput(sink func([]byte) error) *output {
+	return &output{sink: sink, limit: r.outputLimit}
+}
+
+// Write implements [io.Writer].
+func (o *output) Write(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	n := len(p)
+	if o.limit > 0 && o.written+n > o.limit {
+		n = o.limit - o.written
+		o.err = fmt.Errorf("%w: output truncated after %d bytes", ErrOutputLimit, o.limit)
+	}
+	o.buf = append(o.buf, p[:n]...)
+	o.written += n
+	if len(o.buf) >= chunkSize {
+		if err := o.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, o.err
+}
+
+// account counts data sent along with the output, like the encoded result, against the limit.
+func (o *output) account(n int) error {
+	if o.err != nil {
+		return o.err
+	}
+	if o.limit > 0 && o.written+n > o.limit {
+		o.err = fmt.Errorf("%w: result of %d bytes not sent", ErrOutputLimit, n)
+		return o.err
+	}
+	o.written += n
+	return nil
+}
+
+// Flush forwards buffered output to the sink.
+func (o *output) Flush() error {
+	if len(o.buf) == 0 {
+		return nil
+	}
+	// The sink may retain the chunk.
+	chunk := o.buf
+	o.buf = nil
+	if err := o.sink(chunk); err != nil && o.err == nil {
+		o.err = err
+	}
+	return o.err
+}
+
+// Rest returns the buffered output that was not forwarded to the sink yet.
+func (o *output) Rest() string {
+	rest := string(o.buf)
+	o.buf = nil
+	return rest
+}
+
+// Err returns the error that occurred while writing, if any.
+func (o *output) Err() error {
+	return o.err
+}
+
+// writeStdout is the output sink of the terminal REPL.
+func writeStdout(chunk []byte) error {
+	_, err := os.Stdout.Write(chunk)
+	return err
+}
+
+// stream decouples writing output chunks to a client from the command's execution.
+//
+// Chunks are handed to a separate goroutine, so that the simulation is only blocked
+// if the client can't keep up with a buffer of several chunks.
+type stream struct {
+	ctx    context.Context
+	chunks chan []byte
+	done   chan struct{}
+	err    error
+}
+
+// newStream starts a stream that writes chunks with the given function.
+// The stream is aborted when the context is done.
+func newStream(ctx context.Context, write func([]byte) error) *stream {
+	s := stream{
+		ctx:    ctx,
+		chunks: make(chan []byte, streamBuffer),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		for chunk := range s.chunks {
+			if s.err != nil {
+				continue
+			}
+			s.err = write(chunk)
+		}
+	}()
+	return &s
+}
+
+// Send is the sink for an [output].
+func (s *stream) Send(chunk []byte) error {
+	select {
+	case s.chunks <- chunk:
+		return nil
+	case <-s.ctx.Done():
+		return context.Cause(s.ctx)
+	}
+}
+
+// Close waits until all chunks are written.
+// Returns the first error that occurred while writing.
+func (s *stream) Close() error {
+	close(s.chunks)
+	<-s.done
+	return s.err
+}
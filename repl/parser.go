@@ -5,10 +5,57 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
-func parseInput(input string, commandRegistry map[string]commandEntry) (Command, bool, error) {
-	tokens := strings.Fields(input)
+func parseInput(input string, commandRegistry map[string]commandEntry) (helper, bool, error) {
+	tokens, err := splitArgs(input)
+	if err != nil {
+		return nil, false, err
+	}
+	return parseArgs(tokens, commandRegistry)
+}
+
+// splitArgs splits a command line at whitespace.
+// Single or double quotes group text with whitespace, like in where="Position.X > 5".
+// The outer quotes are removed.
+func splitArgs(input string) ([]string, error) {
+	tokens := []string{}
+	current := strings.Builder{}
+	inToken := false
+	var quote rune
+	for _, r := range input {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command: %s", input)
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+func parseArgs(tokens []string, commandRegistry map[string]commandEntry) (helper, bool, error) {
 	if len(tokens) < 1 {
 		return nil, false, fmt.Errorf("no command provided")
 	}
@@ -27,15 +74,15 @@ func parseInput(input string, commandRegistry map[string]commandEntry) (Command,
 		if err := setDefaults(cmdVal); err != nil {
 			return nil, false, err
 		}
-		cmd, ok := cmdVal.Interface().(Command)
+		cmd, ok := cmdVal.Interface().(helper)
 		if !ok {
-			return nil, false, fmt.Errorf("command %s does not implement interface Command", cmdName)
+			return nil, false, fmt.Errorf("command %s does not implement interface Command or Runner", cmdName)
 		}
 		return cmd, false, nil
 	}
 
 	if cmdVal.Type() == reflect.TypeFor[help]() {
-		cmd, _, err := parseInput(strings.Join(tokens[1:], " "), commandRegistry)
+		cmd, _, err := parseArgs(tokens[1:], commandRegistry)
 		return cmd, true, err
 	}
 
@@ -49,6 +96,9 @@ func parseInput(input string, commandRegistry map[string]commandEntry) (Command,
 		subcmdName := tokens[i]
 		subcmdField := cmdVal.FieldByNameFunc(func(s string) bool { return strings.ToLower(s) == subcmdName })
 		if !subcmdField.IsValid() {
+			if len(taggedFields(cmdVal, "positional")) > 0 {
+				break
+			}
 			return nil, false, fmt.Errorf("unknown subcommand or bool option: %s", subcmdName)
 		}
 		if subcmdField.Kind() == reflect.Bool {
@@ -67,10 +117,29 @@ func parseInput(input string, commandRegistry map[string]commandEntry) (Command,
 	}
 
 	// Parse args
+	positional := taggedFields(cmdVal, "positional")
+	extra := taggedFields(cmdVal, "extra")
 	for i < len(tokens) {
 		kv := strings.SplitN(tokens[i], "=", 2)
 		cmdName = kv[0]
 		field := cmdVal.FieldByNameFunc(func(s string) bool { return strings.ToLower(s) == cmdName })
+		if len(kv) == 1 && (!field.IsValid() || field.Kind() != reflect.Bool) && len(positional) > 0 {
+			// Value of the next positional option.
+			name := cmdVal.Type().Field(positional[0]).Name
+			if err := setField(cmdVal.Field(positional[0]), []string{strings.ToLower(name), tokens[i]}); err != nil {
+				return nil, false, err
+			}
+			positional = positional[1:]
+			i++
+			continue
+		}
+		if !field.IsValid() && len(kv) == 2 && len(extra) > 0 {
+			// Unknown key-value pairs are collected as they are, like "Position.X=10".
+			extraField := cmdVal.Field(extra[0])
+			extraField.Set(reflect.Append(extraField, reflect.ValueOf(tokens[i])))
+			i++
+			continue
+		}
 		if !field.IsValid() || !field.CanSet() {
 			return nil, false, fmt.Errorf("invalid option: %s", cmdName)
 		}
@@ -85,13 +154,27 @@ func parseInput(input string, commandRegistry map[string]commandEntry) (Command,
 		i++
 	}
 
-	exec, ok := cmdVal.Interface().(Command)
+	exec, ok := cmdVal.Interface().(helper)
 	if !ok {
-		return nil, false, fmt.Errorf("command %s does not implement interface Command", cmdName)
+		return nil, false, fmt.Errorf("command %s does not implement interface Command or Runner", cmdName)
 	}
 	return exec, false, nil
 }
 
+// taggedFields returns the indices of the options with the given struct tag key.
+//
+// Options tagged `positional:""` can be given without name, in the order of declaration.
+// An option of type []string tagged `extra:""` collects all key-value pairs with unknown keys.
+func taggedFields(cmdVal reflect.Value, tag string) []int {
+	indices := []int{}
+	for i := range cmdVal.NumField() {
+		if _, ok := cmdVal.Type().Field(i).Tag.Lookup(tag); ok {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
 func setDefaults(cmdVal reflect.Value) error {
 	for i := range cmdVal.NumField() {
 		typeField := cmdVal.Type().Field(i)
@@ -175,7 +258,7 @@ func setField(field reflect.Value, kv []string) error {
 	return nil
 }
 
-func extractHelp(cmd Command, out *strings.Builder) error {
+func extractHelp(cmd helper, out *strings.Builder) error {
 	commands := []string{}
 	cmdHelp := []string{}
 	options := []string{}
@@ -185,13 +268,16 @@ func extractHelp(cmd Command, out *strings.Builder) error {
 	for i := range cmdVal.NumField() {
 		field := cmdVal.Field(i)
 		typeField := cmdVal.Type().Field(i)
+		if !typeField.IsExported() {
+			continue
+		}
 
 		if field.Kind() == reflect.Struct {
 			cmdName := strings.ToLower(typeField.Name)
 			commands = append(commands, cmdName)
-			interf, ok := field.Interface().(Command)
+			interf, ok := field.Interface().(helper)
 			if !ok {
-				return fmt.Errorf("command %s does not implement interface Command", cmdName)
+				return fmt.Errorf("command %s does not implement interface Command or Runner", cmdName)
 			}
 			out := strings.Builder{}
 			interf.Help(&out)
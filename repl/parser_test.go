@@ -80,6 +80,33 @@ func TestParser(t *testing.T) {
 	assert.True(t, ok)
 }
 
+type positionalCmd struct {
+	First  string `positional:""`
+	Flag   bool
+	Second int      `positional:""`
+	Rest   []string `extra:""`
+}
+
+func (c positionalCmd) Execute(world *ecs.World, out *strings.Builder) {}
+func (c positionalCmd) Help(out *strings.Builder)                      {}
+
+func TestParserPositional(t *testing.T) {
+	allCommands := map[string]commandEntry{
+		"cmd": {positionalCmd{}, true},
+	}
+
+	out, _, err := parseInput("cmd a flag 5", allCommands)
+	assert.Nil(t, err)
+	assert.Equal(t, `repl.positionalCmd{First:"a", Flag:true, Second:5, Rest:[]string(nil)}`, fmt.Sprintf("%#v", out))
+
+	out, _, err = parseInput("cmd second=5 A.x=1,2 first=a B=", allCommands)
+	assert.Nil(t, err)
+	assert.Equal(t, `repl.positionalCmd{First:"a", Flag:false, Second:5, Rest:[]string{"A.x=1,2", "B="}}`, fmt.Sprintf("%#v", out))
+
+	_, _, err = parseInput("cmd a 5 b", allCommands)
+	assert.Equal(t, "invalid option: b", err.Error())
+}
+
 func TestParserListEntities(t *testing.T) {
 	cmdString := "query comps=Position with=Velocity"
 	out, help, err := parseInput(cmdString, defaultCommands(nil))
@@ -87,7 +114,16 @@ func TestParserListEntities(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, out)
 	assert.False(t, help)
-	assert.Equal(t, `repl.query{N:25, Page:0, Comps:[]string{"Position"}, With:[]string{"Velocity"}, Without:[]string(nil), Exclusive:false, Full:false}`, fmt.Sprintf("%#v", out))
+	assert.Equal(t, `repl.query{N:25, Page:0, Comps:[]string{"Position"}, With:[]string{"Velocity"}, Without:[]string(nil), Exclusive:false, Where:"", Rel:[]string(nil), Sort:"", Fields:[]string(nil), Full:false}`, fmt.Sprintf("%#v", out))
+}
+
+func TestSplitArgs(t *testing.T) {
+	tokens, err := splitArgs(`query  where="Position.X > 5 && Name == 'a b'" n=5 '' x`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"query", "where=Position.X > 5 && Name == 'a b'", "n=5", "", "x"}, tokens)
+
+	_, err = splitArgs(`query where="Position.X > 5`)
+	assert.NotNil(t, err)
 }
 
 func TestExtractHelp(t *testing.T) {
@@ -0,0 +1,295 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// Partial blocks for histogram bars, in eighths of a character.
+var barBlocks = []rune(" ▏▎▍▌▋▊▉█")
+
+type hist struct {
+	Field     string   `help:"Numeric field to plot, like Position.X."`
+	Bins      int      `default:"20" help:"Number of bins."`
+	Width     int      `default:"50" help:"Maximum width of the bars in characters."`
+	Comps     []string `help:"Components of the query."`
+	With      []string `help:"Additional components to filter for."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+// histResult is the structured result of the hist command.
+type histResult struct {
+	Field   string    `json:"field"`
+	Count   int       `json:"count"`
+	Skipped int       `json:"skipped"`
+	Bins    []histBin `json:"bins"`
+}
+
+// tableData returns the bins.
+func (r histResult) tableData() any {
+	return r.Bins
+}
+
+// histBin is a bin of a histogram, from Min (inclusive) to Max (exclusive, except for the last bin).
+type histBin struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+func (c hist) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.Field == "" {
+		return nil, errors.New("no field given; use field=<Component.Field>")
+	}
+	if c.Bins < 1 || c.Width < 1 {
+		return nil, errors.New("bins and width must be at least 1")
+	}
+	values, skipped, err := collectNumbers(world, filterSpec{
+		comps: c.Comps, with: c.With, without: c.Without,
+		exclusive: c.Exclusive, where: c.Where, rel: c.Rel,
+	}, c.Field)
+	if err != nil {
+		return nil, err
+	}
+	result := histResult{Field: c.Field, Count: len(values[0]), Skipped: skipped, Bins: []histBin{}}
+	if len(values[0]) == 0 {
+		fmt.Fprintln(out, "No matching entities")
+		return result, nil
+	}
+
+	lo, hi := valueRange(values[0])
+	step := (hi - lo) / float64(c.Bins)
+	edge := func(i int) float64 {
+		if math.IsInf(step, 0) {
+			// The range exceeds the largest float, so add up halves.
+			half := (hi/2 - lo/2) / float64(c.Bins) * float64(i)
+			return lo + half + half
+		}
+		return lo + float64(i)*step
+	}
+	for i := range c.Bins {
+		result.Bins = append(result.Bins, histBin{Min: edge(i), Max: edge(i + 1)})
+	}
+	maxCount := 0
+	for _, v := range values[0] {
+		bin := scaleIndex(v, lo, hi, c.Bins)
+		result.Bins[bin].Count++
+		maxCount = max(maxCount, result.Bins[bin].Count)
+	}
+
+	labels := make([]string, len(result.Bins))
+	counts := make([]string, len(result.Bins))
+	labelWidth, countWidth := 0, 0
+	for i, bin := range result.Bins {
+		closing := ")"
+		if i == len(result.Bins)-1 {
+			closing = "]"
+		}
+		labels[i] = fmt.Sprintf("[%s, %s%s", formatNumber(bin.Min), formatNumber(bin.Max), closing)
+		counts[i] = fmt.Sprint(bin.Count)
+		labelWidth = max(labelWidth, len(labels[i]))
+		countWidth = max(countWidth, len(counts[i]))
+	}
+
+	fmt.Fprintf(out, "%s (%d entities)\n", c.Field, result.Count)
+	for i, bin := range result.Bins {
+		fmt.Fprintf(out, "%-*s  %*s  %s\n", labelWidth, labels[i], countWidth, counts[i], bar(bin.Count, maxCount, c.Width))
+	}
+	if skipped > 0 {
+		fmt.Fprintf(out, "Skipped %d non-finite values\n", skipped)
+	}
+	return result, nil
+}
+
+func (c hist) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Plot a histogram of a numeric component field.")
+	fmt.Fprintln(out, "Supports the same filters as query.")
+}
+
+type plot struct {
+	X         string   `help:"Numeric field for the x axis, like Position.X."`
+	Y         string   `help:"Numeric field for the y axis, like Position.Y."`
+	Width     int      `default:"60" help:"Width of the plot in characters."`
+	Height    int      `default:"20" help:"Height of the plot in characters."`
+	Comps     []string `help:"Components of the query."`
+	With      []string `help:"Additional components to filter for."`
+	Without   []string `help:"Only entities without these components."`
+	Exclusive bool     `help:"Only entities with exactly the components in 'with'."`
+	Where     string   `help:"Filter expression, like \"Position.X > 50 && Velocity.Y != 0\"."`
+	Rel       []string `help:"Relation targets, like ChildOf:5."`
+}
+
+// plotResult is the structured result of the plot command.
+type plotResult struct {
+	X       string   `json:"x"`
+	Y       string   `json:"y"`
+	Count   int      `json:"count"`
+	Skipped int      `json:"skipped"`
+	XMin    float64  `json:"xMin"`
+	XMax    float64  `json:"xMax"`
+	YMin    float64  `json:"yMin"`
+	YMax    float64  `json:"yMax"`
+	Lines   []string `json:"lines"`
+}
+
+func (c plot) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.X == "" || c.Y == "" {
+		return nil, errors.New("no fields given; use x=<Component.Field> y=<Component.Field>")
+	}
+	if c.Width < 1 || c.Height < 1 {
+		return nil, errors.New("width and height must be at least 1")
+	}
+	values, skipped, err := collectNumbers(world, filterSpec{
+		comps: c.Comps, with: c.With, without: c.Without,
+		exclusive: c.Exclusive, where: c.Where, rel: c.Rel,
+	}, c.X, c.Y)
+	if err != nil {
+		return nil, err
+	}
+	xs, ys := values[0], values[1]
+	result := plotResult{X: c.X, Y: c.Y, Count: len(xs), Skipped: skipped, Lines: []string{}}
+	if len(xs) == 0 {
+		fmt.Fprintln(out, "No matching entities")
+		return result, nil
+	}
+
+	result.XMin, result.XMax = valueRange(xs)
+	result.YMin, result.YMax = valueRange(ys)
+
+	// Braille characters have 2x4 dots per cell.
+	cells := make([][]rune, c.Height)
+	for i := range cells {
+		cells[i] = make([]rune, c.Width)
+	}
+	dotsX, dotsY := c.Width*2, c.Height*4
+	for i := range xs {
+		px := scaleIndex(xs[i], result.XMin, result.XMax, dotsX)
+		py := dotsY - 1 - scaleIndex(ys[i], result.YMin, result.YMax, dotsY)
+		cells[py/4][px/2] |= brailleDot(px%2, py%4)
+	}
+	for _, row := range cells {
+		line := make([]rune, len(row))
+		for i, dots := range row {
+			if dots == 0 {
+				line[i] = ' '
+			} else {
+				line[i] = 0x2800 + dots
+			}
+		}
+		result.Lines = append(result.Lines, string(line))
+	}
+
+	yMax, yMin := formatNumber(result.YMax), formatNumber(result.YMin)
+	labelWidth := max(len(yMax), len(yMin))
+	fmt.Fprintf(out, "%s vs. %s (%d entities)\n", c.Y, c.X, result.Count)
+	for i, line := range result.Lines {
+		label := ""
+		switch i {
+		case 0:
+			label = yMax
+		case len(result.Lines) - 1:
+			label = yMin
+		}
+		fmt.Fprintf(out, "%*s │%s\n", labelWidth, label, line)
+	}
+	fmt.Fprintf(out, "%*s └%s\n", labelWidth, "", strings.Repeat("─", c.Width))
+	xMin, xMax := formatNumber(result.XMin), formatNumber(result.XMax)
+	fmt.Fprintf(out, "%*s  %s%*s\n", labelWidth, "", xMin, max(c.Width-len(xMin), len(xMax)+1), xMax)
+	if skipped > 0 {
+		fmt.Fprintf(out, "Skipped %d non-finite values\n", skipped)
+	}
+	return result, nil
+}
+
+func (c plot) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Scatter plot of two numeric component fields.")
+	fmt.Fprintln(out, "Supports the same filters as query.")
+}
+
+// collectNumbers collects the values of numeric fields for all entities matching a filter spec.
+// Entities with a non-finite value in any field are skipped, and their number is returned.
+func collectNumbers(world *ecs.World, spec filterSpec, paths ...string) ([][]float64, int, error) {
+	fields, err := resolveFieldList(world, paths)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range fields {
+		if kind, ok := fieldKind(fields[i].typ); !ok || kind != kindNumber {
+			return nil, 0, fmt.Errorf("can't plot '%s' of type %s; only numeric fields are supported", fields[i].name, fields[i].typ)
+		}
+	}
+
+	values := make([][]float64, len(fields))
+	for i := range values {
+		values[i] = []float64{}
+	}
+	row := make([]float64, len(fields))
+	skipped := 0
+	err = forEachEntity(world, spec, fields, func(query *ecs.UnsafeQuery) {
+		for i := range fields {
+			row[i] = numberValue(fields[i].value(query.Get))
+			if math.IsNaN(row[i]) || math.IsInf(row[i], 0) {
+				skipped++
+				return
+			}
+		}
+		for i := range fields {
+			values[i] = append(values[i], row[i])
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return values, skipped, nil
+}
+
+// valueRange returns the minimum and maximum of values.
+// If all values are equal, the range is extended to a width of 1.
+func valueRange(values []float64) (float64, float64) {
+	lo, hi := values[0], values[0]
+	for _, v := range values[1:] {
+		lo = min(lo, v)
+		hi = max(hi, v)
+	}
+	if lo == hi {
+		return lo - 0.5, hi + 0.5
+	}
+	return lo, hi
+}
+
+// scaleIndex maps a value in the range from lo to hi to an index from 0 to n-1.
+// Values are halved, so that the span between finite values can't overflow.
+func scaleIndex(v, lo, hi float64, n int) int {
+	pos := (v/2 - lo/2) / (hi/2 - lo/2) * float64(n)
+	if !(pos >= 0) {
+		// Negative or NaN, for a range too small to extend.
+		return 0
+	}
+	return min(int(pos), n-1)
+}
+
+// bar returns a bar of partial block characters for a count, scaled to width.
+func bar(count, maxCount, width int) string {
+	eighths := count * width * 8 / maxCount
+	if count > 0 && eighths == 0 {
+		eighths = 1
+	}
+	return strings.Repeat(string(barBlocks[8]), eighths/8) + strings.TrimRight(string(barBlocks[eighths%8]), " ")
+}
+
+// brailleDot returns the bit of a dot in a braille character,
+// for column 0-1 and row 0-3.
+func brailleDot(col, row int) rune {
+	if row == 3 {
+		return 0x40 << col
+	}
+	return 1 << (row + 3*col)
+}
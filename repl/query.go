@@ -0,0 +1,199 @@
+package repl
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// entityPrinter formats entities for the query command.
+type entityPrinter struct {
+	compTypes []reflect.Type
+	relations []bool
+	comps     []ecs.ID
+	fields    []fieldPath
+	full      bool
+	strings   []string
+}
+
+// newEntityPrinter creates a printer.
+// If fields are given, only these are shown.
+// Otherwise, all components are shown if full is true, or the given components if not.
+func newEntityPrinter(world *ecs.World, comps []ecs.ID, fields []fieldPath, full bool) *entityPrinter {
+	allIDs := ecs.ComponentIDs(world)
+	compTypes := make([]reflect.Type, 0, len(allIDs))
+	relations := make([]bool, 0, len(allIDs))
+	for _, id := range allIDs {
+		info, _ := ecs.ComponentInfo(world, id)
+		compTypes = append(compTypes, info.Type)
+		relations = append(relations, info.IsRelation)
+	}
+	return &entityPrinter{
+		compTypes: compTypes,
+		relations: relations,
+		comps:     comps,
+		fields:    fields,
+		full:      full,
+	}
+}
+
+// print writes an entity and returns its structured representation.
+// Relation components are shown with their target, like "ChildOf{}->{2 0}".
+// Fails if writing fails, e.g. because the output limit is exceeded.
+func (p *entityPrinter) print(out io.Writer, entity ecs.Entity, get getter, ids func() ecs.IDs, rel func(ecs.ID) ecs.Entity) (entityValue, error) {
+	value := entityValue{Entity: entity, Components: map[string]any{}}
+	p.strings = p.strings[:0]
+
+	if len(p.fields) > 0 {
+		for i := range p.fields {
+			f := &p.fields[i]
+			val := f.value(get).Interface()
+			p.strings = append(p.strings, fmt.Sprintf("%s=%+v", f.name, val))
+			value.Components[f.name] = val
+		}
+	} else {
+		show := p.comps
+		if p.full {
+			allIDs := ids()
+			show = make([]ecs.ID, allIDs.Len())
+			for i := range allIDs.Len() {
+				show[i] = allIDs.Get(i)
+			}
+		}
+		for _, id := range show {
+			tp := p.compTypes[id.Index()]
+			val := reflect.NewAt(tp, get(id)).Elem().Interface()
+			p.strings = append(p.strings, fmt.Sprintf("%s%+v", tp.Name(), val))
+			value.Components[tp.Name()] = val
+			if p.relations[id.Index()] {
+				target := rel(id)
+				p.strings[len(p.strings)-1] += fmt.Sprintf("->%v", target)
+				if value.Relations == nil {
+					value.Relations = map[string]ecs.Entity{}
+				}
+				value.Relations[tp.Name()] = target
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(out, "%v: %s\n", entity, strings.Join(p.strings, " "))
+	return value, err
+}
+
+// sortKey of the query command.
+type sortKey struct {
+	field fieldPath
+	kind  valueKind
+	desc  bool
+}
+
+// parseSortKeys parses a sort specification like "Velocity.X desc,Position.Y".
+func parseSortKeys(world *ecs.World, spec string) ([]sortKey, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	keys := []sortKey{}
+	for _, part := range strings.Split(spec, ",") {
+		tokens := strings.Fields(part)
+		if len(tokens) < 1 || len(tokens) > 2 {
+			return nil, fmt.Errorf("invalid sort key '%s'; expected '<field> [asc|desc]'", strings.TrimSpace(part))
+		}
+		field, err := resolveField(world, tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		kind, ok := fieldKind(field.typ)
+		if !ok {
+			return nil, fmt.Errorf("can't sort by '%s' of type %s; only numbers, strings and bools are supported", tokens[0], field.typ)
+		}
+		key := sortKey{field: field, kind: kind}
+		if len(tokens) == 2 {
+			switch strings.ToLower(tokens[1]) {
+			case "asc":
+			case "desc":
+				key.desc = true
+			default:
+				return nil, fmt.Errorf("invalid sort order '%s'; expected 'asc' or 'desc'", tokens[1])
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortRow is an entity with its values for sorting.
+type sortRow struct {
+	entity  ecs.Entity
+	numbers []float64
+	strings []string
+}
+
+// newSortRow extracts the sort values of the current entity.
+func newSortRow(entity ecs.Entity, get getter, keys []sortKey) sortRow {
+	row := sortRow{entity: entity, numbers: make([]float64, len(keys)), strings: make([]string, len(keys))}
+	for i := range keys {
+		v := keys[i].field.value(get)
+		if keys[i].kind == kindString {
+			row.strings[i] = v.String()
+		} else {
+			row.numbers[i] = numberValue(v)
+		}
+	}
+	return row
+}
+
+// sortRows sorts rows by the given keys, keeping the iteration order for equal rows.
+func sortRows(rows []sortRow, keys []sortKey) {
+	slices.SortStableFunc(rows, func(a, b sortRow) int {
+		for i := range keys {
+			var c int
+			if keys[i].kind == kindString {
+				c = strings.Compare(a.strings[i], b.strings[i])
+			} else {
+				c = cmp.Compare(a.numbers[i], b.numbers[i])
+			}
+			if keys[i].desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// forEachEntity calls fn for each entity that matches a filter spec.
+// Fields are added to the required components of the filter.
+func forEachEntity(world *ecs.World, spec filterSpec, fields []fieldPath, fn func(query *ecs.UnsafeQuery)) error {
+	for _, f := range fields {
+		spec.require = append(spec.require, f.comp)
+	}
+	filter, err := newFilter(world, spec)
+	if err != nil {
+		return err
+	}
+	where := filter.where
+
+	query := filter.query()
+	closed := false
+	defer func() {
+		// Unlock the world if fn panicked.
+		if !closed {
+			query.Close()
+		}
+	}()
+	for query.Next() {
+		if where != nil && !where.eval(query.Get) {
+			continue
+		}
+		fn(&query)
+	}
+	closed = true
+	return nil
+}
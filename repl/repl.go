@@ -1,20 +1,62 @@
 package repl
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
-	"os"
 	"reflect"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/goccy/go-json"
 	"github.com/mlange-42/ark-repl/internal/monitor"
 	"github.com/mlange-42/ark/ecs"
 )
 
 var exitCmd = reflect.TypeFor[exit]()
 
+// ErrClosed is returned for commands that could not be executed because the REPL was shut down.
+var ErrClosed = errors.New("repl: closed")
+
+// ErrStarted is returned when starting the terminal REPL while it is already running.
+var ErrStarted = errors.New("repl: already started")
+
+// ErrTimeout is returned for commands that were not executed by [Repl.Poll] within the timeout.
+var ErrTimeout = errors.New("repl: timeout")
+
+// ErrCanceled is returned for commands that were canceled by the client before execution.
+var ErrCanceled = errors.New("repl: command canceled")
+
+// ErrBusy is returned for commands that were rejected because the command queue is full.
+var ErrBusy = errors.New("repl: busy; too many queued commands, try again later")
+
+const (
+	// defaultTimeout for commands to be picked up by [Repl.Poll].
+	defaultTimeout = 10 * time.Second
+	// defaultQueueSize is the default maximum number of queued commands.
+	defaultQueueSize = 32
+)
+
+// States of queued commands.
+const (
+	taskQueued int32 = iota
+	taskRunning
+	taskCanceled
+)
+
+// queuedTask is a command waiting for execution by [Repl.Poll].
+type queuedTask struct {
+	state atomic.Int32
+	run   func()
+}
+
 // Callbacks for simulation loop control.
 // Individual callbacks are optional, but required to enable the resp. functionality.
 type Callbacks struct {
@@ -24,19 +66,38 @@ type Callbacks struct {
 	Resume func(out *strings.Builder)
 	// Stop the simulation.
 	Stop func(out *strings.Builder)
-	// Get the current simulation tick. Used to calculate frame rate.
+	// Get the current simulation tick. Used to calculate frame rate, and to count ticks for diff.
 	Ticks func() int
 }
 
 // Repl is the main entry point.
 type Repl struct {
-	channel   chan func()
+	channel   chan *queuedTask
+	queueMu   sync.Mutex
 	init      chan struct{}
 	world     *ecs.World
 	callbacks Callbacks
 	commands  map[string]commandEntry
 	system    System
-	started   bool
+	token     string
+	budget    time.Duration
+
+	// Can be changed while sessions are running.
+	logger  atomic.Pointer[slog.Logger]
+	timeout atomic.Int64
+
+	outputLimit int
+
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	wg        sync.WaitGroup
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	terminal  bool
+	polled    chan struct{}
+	polls     int
+	reset     chan struct{}
 }
 
 func defaultCommands(r *Repl) map[string]commandEntry {
@@ -46,12 +107,27 @@ func defaultCommands(r *Repl) map[string]commandEntry {
 		"resume": {resume{r}, true},
 		"stop":   {stop{r}, true},
 		"exit":   {exit{}, true},
+		"format": {formatCmd{}, true},
 
-		"stats":   {stats{}, true},
-		"list":    {list{}, true},
-		"query":   {query{}, true},
-		"shrink":  {shrink{}, true},
-		"monitor": {runTui{}, true},
+		"stats":    {stats{}, true},
+		"list":     {list{}, true},
+		"query":    {query{}, true},
+		"agg":      {agg{}, true},
+		"hist":     {hist{}, true},
+		"plot":     {plot{}, true},
+		"entity":   {entityCmd{}, true},
+		"set":      {set{}, true},
+		"spawn":    {spawn{}, true},
+		"despawn":  {despawn{}, true},
+		"comp":     {comp{}, true},
+		"resource": {resource{}, true},
+		"tree":     {tree{}, true},
+		"save":     {save{}, true},
+		"load":     {load{repl: r}, true},
+		"diff":     {diff{repl: r}, true},
+		"trace":    {trace{repl: r}, true},
+		"shrink":   {shrink{}, true},
+		"monitor":  {runTui{}, true},
 
 		"stats-json": {getStats{r}, false},
 	}
@@ -59,11 +135,23 @@ func defaultCommands(r *Repl) map[string]commandEntry {
 
 // NewRepl creates a new [Repl].
 func NewRepl(world *ecs.World, callbacks Callbacks) *Repl {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	// Closed until the terminal REPL runs initial commands.
+	init := make(chan struct{})
+	close(init)
+
 	repl := Repl{
-		channel:   make(chan func()),
-		init:      make(chan struct{}),
-		world:     world,
-		callbacks: callbacks,
+		channel:     make(chan *queuedTask, defaultQueueSize),
+		init:        init,
+		world:       world,
+		callbacks:   callbacks,
+		outputLimit: defaultOutputLimit,
+		ctx:         ctx,
+		cancel:      cancel,
+		listeners:   map[net.Listener]struct{}{},
+		conns:       map[net.Conn]struct{}{},
+		polled:      make(chan struct{}),
+		reset:       make(chan struct{}),
 	}
 
 	commands := map[string]commandEntry{}
@@ -73,6 +161,7 @@ func NewRepl(world *ecs.World, callbacks Callbacks) *Repl {
 
 	repl.commands = commands
 	repl.system = System{repl: &repl}
+	repl.timeout.Store(int64(defaultTimeout))
 	return &repl
 }
 
@@ -87,51 +176,169 @@ func (r *Repl) AddCommand(name string, cmd Command) error {
 	return nil
 }
 
-// Start the REPL.
+// AddRunner adds a command that reports errors and structured results to the REPL.
+//
+// Returns an error if a command with the same name is already registered.
+func (r *Repl) AddRunner(name string, cmd Runner) error {
+	if _, ok := r.commands[name]; ok {
+		return fmt.Errorf("command '%s' is already registered", name)
+	}
+	r.commands[name] = commandEntry{cmd, true}
+	return nil
+}
+
+// SetToken sets a shared secret that clients connecting to [Repl.StartServer] must provide.
+//
+// Clients using the ark CLI pass the token via flag or environment variable.
+// Plain-text clients (e.g. nc) must send "auth <token>" as their first line.
+// An empty token disables authentication, which is the default.
+// Should be called before [Repl.StartServer].
+func (r *Repl) SetToken(token string) {
+	r.token = token
+}
+
+// SetLogger sets the logger for diagnostic messages, like connection errors.
+// By default, [slog.Default] is used.
+// Can be called at any time; it is safe for concurrent use.
+func (r *Repl) SetLogger(logger *slog.Logger) {
+	r.logger.Store(logger)
+}
+
+// SetTimeout sets how long commands wait to be executed by [Repl.Poll].
+// Clients get an error if the simulation does not poll in time, e.g. because it is blocked or stopped.
+// Commands that are already executing are not interrupted.
+//
+// The default is 10 seconds. Zero or a negative value disables the timeout.
+// Clients using the ark CLI can override the timeout per command.
+// Can be called at any time, and applies to commands submitted afterwards; it is safe for concurrent use.
+func (r *Repl) SetTimeout(timeout time.Duration) {
+	r.timeout.Store(int64(timeout))
+}
+
+// commandTimeout returns the timeout set by [Repl.SetTimeout].
+func (r *Repl) commandTimeout() time.Duration {
+	return time.Duration(r.timeout.Load())
+}
+
+// SetQueueSize sets the maximum number of commands waiting for [Repl.Poll].
+// Further commands are rejected with [ErrBusy] until the queue has space again.
+// Commands that timed out or were canceled while waiting don't count.
+//
+// The default is 32. Must be called before starting the REPL.
+func (r *Repl) SetQueueSize(size int) {
+	r.channel = make(chan *queuedTask, max(size, 1))
+}
+
+// SetPollBudget sets the time budget for executing commands in a single call to [Repl.Poll].
+// After the budget is exceeded, remaining commands are deferred to the next call.
+// At least one command is executed per call, regardless of the budget.
+//
+// The default is zero, which means no limit.
+func (r *Repl) SetPollBudget(budget time.Duration) {
+	r.budget = budget
+}
+
+// SetOutputLimit sets the maximum output size of a single command, in bytes.
+// Output beyond the limit is discarded, and the client gets an [ErrOutputLimit] error.
+// Structured results requested by clients count against the limit as well.
+//
+// The default is 16 MiB. Zero or a negative value disables the limit.
+func (r *Repl) SetOutputLimit(limit int) {
+	r.outputLimit = limit
+}
+
+// log returns the logger for diagnostic messages.
+func (r *Repl) log() *slog.Logger {
+	if logger := r.logger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Start the REPL in the terminal.
 //
 // Commands to execute at the first [Repl.Poll] call can be given as arguments (e.g. "pause", "monitor", ...).
 //
 // Note that a 'monitor' command, if given, is deferred after all other commands.
-func (r *Repl) Start(commands ...string) {
-	if r.started {
-		fmt.Println("ERROR: REPL server is already running.")
-		os.Exit(1)
+//
+// The terminal REPL can run alongside any number of servers started with [Repl.StartServer].
+// All front-ends share the same commands and are served by [Repl.Poll].
+//
+// Returns [ErrStarted] if the terminal REPL is already running.
+func (r *Repl) Start(commands ...string) error {
+	r.mu.Lock()
+	if r.terminal {
+		r.mu.Unlock()
+		return ErrStarted
 	}
-	r.started = true
+	r.terminal = true
+	r.renew()
+	if isClosed(r.init) {
+		r.init = make(chan struct{})
+	}
+	ctx, init := r.ctx, r.init
+	r.wg.Add(1)
+	r.mu.Unlock()
+
 	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
+		defer func() {
+			r.mu.Lock()
+			if r.ctx == ctx {
+				r.terminal = false
+			}
+			r.mu.Unlock()
+			r.wg.Done()
+		}()
 		fmt.Println("Ark REPL started. Type 'help' for commands.")
 
-		if r.runInitialCommands(commands) {
-			monitor.New(&localConnection{repl: r})
+		opts := newSettings()
+		opts.interrupt = func(done <-chan struct{}) bool {
+			stdin.readLine(done)
+			return !isClosed(done)
+		}
+		opts.stopHint = "press Enter to stop"
+		if r.runInitialCommands(ctx, opts, init, commands) {
+			r.runMonitor(ctx)
 		}
 
 		for {
 			fmt.Print("> ")
-			if !scanner.Scan() {
+			line, ok := stdin.readLine(ctx.Done())
+			if !ok {
 				break
 			}
-			line := strings.TrimSpace(scanner.Text())
+			line = strings.TrimSpace(line)
 			if line == "" {
 				continue
 			}
 
 			if line == "monitor" {
-				monitor.New(&localConnection{repl: r})
+				r.runMonitor(ctx)
 				continue
 			}
 
-			var out strings.Builder
-			if !r.handleCommand(line, &out) {
-				fmt.Print(out.String())
+			out := r.newOutput(writeStdout)
+			_, cont, err := r.handleCommand(ctx, opts, line, 0, false, out)
+			_ = out.Flush()
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			if !cont {
 				break
 			}
-			fmt.Print(out.String())
 		}
 	}()
+	return nil
 }
 
-func (r *Repl) runInitialCommands(commands []string) bool {
+// runMonitor runs the monitor TUI in the terminal.
+func (r *Repl) runMonitor(ctx context.Context) {
+	if _, err := monitor.New(ctx, &localConnection{repl: r, ctx: ctx}); err != nil {
+		fmt.Println("Failed to run monitor:", err)
+	}
+}
+
+func (r *Repl) runInitialCommands(ctx context.Context, opts *settings, init chan struct{}, commands []string) bool {
 	runMonitor := false
 	for _, cmd := range commands {
 		fmt.Printf("> %s\n", cmd)
@@ -139,70 +346,178 @@ func (r *Repl) runInitialCommands(commands []string) bool {
 			runMonitor = true
 			continue
 		}
-		var out strings.Builder
-		if !r.handleCommand(cmd, &out) {
-			fmt.Print(out.String())
+		out := r.newOutput(writeStdout)
+		_, cont, err := r.handleCommand(ctx, opts, cmd, 0, false, out)
+		_ = out.Flush()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		if !cont {
 			break
 		}
-		fmt.Print(out.String())
 	}
-	close(r.init)
+	close(init)
 	return runMonitor
 }
 
-// StartServer starts a server for the REPL.
+// renew creates a new context if the REPL was shut down before.
+// The caller must hold the lock.
+func (r *Repl) renew() {
+	if r.ctx.Err() != nil {
+		r.ctx, r.cancel = context.WithCancelCause(context.Background())
+	}
+}
+
+// Shutdown stops all front-ends of the REPL.
 //
-// The addr argument should be either 'host:port' or just ':port'.
-func (r *Repl) StartServer(addr string) {
-	if r.started {
-		fmt.Println("ERROR: REPL server is already running.")
-		os.Exit(1)
-	}
-	r.started = true
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("failed to start REPL server: %s", err)
-		return
+// The server stops accepting connections, connected clients are notified and disconnected,
+// the terminal REPL started by [Repl.Start] stops reading input,
+// and commands waiting for [Repl.Poll] return [ErrClosed] without being executed.
+// The simulation itself is not affected.
+//
+// Shutdown waits until all sessions have ended, or until the context expires.
+// In the latter case, remaining connections are closed forcibly and the context's error is returned.
+//
+// After Shutdown, the REPL can be started again.
+func (r *Repl) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.terminal && len(r.listeners) == 0 {
+		r.mu.Unlock()
+		return nil
 	}
-	fmt.Println("REPL server listening on", addr)
-	close(r.init)
+	r.terminal = false
+	r.cancel(ErrClosed)
+	listeners := r.listeners
+	r.listeners = map[net.Listener]struct{}{}
+	for conn := range r.conns {
+		// Interrupt blocking reads, so that sessions notice the shutdown.
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for ln := range listeners {
+		errs = append(errs, ln.Close())
+	}
+	err := errors.Join(errs...)
 
+	finished := make(chan struct{})
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				fmt.Println("REPL connection error:", err)
-				continue
-			}
-			go r.handleConnection(conn)
-		}
+		r.wg.Wait()
+		close(finished)
 	}()
+
+	select {
+	case <-finished:
+		return err
+	case <-ctx.Done():
+		r.mu.Lock()
+		for conn := range r.conns {
+			_ = conn.Close()
+		}
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Close shuts down the REPL and waits for all sessions to end.
+// See [Repl.Shutdown] for details.
+func (r *Repl) Close() error {
+	return r.Shutdown(context.Background())
 }
 
-// Poll runs all commands.
+// Poll runs all queued commands, or as many as fit into the budget set by [Repl.SetPollBudget].
 func (r *Repl) Poll() {
+	r.mu.Lock()
+	init, done := r.init, r.ctx.Done()
+	r.polls++
+	close(r.polled)
+	r.polled = make(chan struct{})
+	r.mu.Unlock()
+
 	// Block for initial commands
-	if !isClosed(r.init) {
+	if !isClosed(init) {
 		for {
 			select {
-			case cmd := <-r.channel:
-				cmd()
-			case <-r.init:
+			case task := <-r.channel:
+				task.run()
+			case <-init:
 				// init closed, switch to single-command mode
 				return
+			case <-done:
+				return
 			}
 		}
 	}
 
 	// Non-blocking for normal commands
+	var deadline time.Time
+	if r.budget > 0 {
+		deadline = time.Now().Add(r.budget)
+	}
 	for {
 		select {
-		case cmd := <-r.channel:
-			cmd()
+		case task := <-r.channel:
+			task.run()
 		default:
 			return
 		}
+		if r.budget > 0 && time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// waitPoll waits until the next call to [Repl.Poll] starts.
+// Fails like [Repl.execCommand] if the context is done before.
+func (r *Repl) waitPoll(ctx context.Context, timeout time.Duration) error {
+	r.mu.Lock()
+	polled := r.polled
+	r.mu.Unlock()
+
+	ctx, cancel := r.withTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case <-polled:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// nextReset returns a channel that is closed when the world is reset by the load command,
+// which also removes all observers.
+func (r *Repl) nextReset() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reset
+}
+
+// notifyReset notifies commands waiting for [Repl.nextReset].
+func (r *Repl) notifyReset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.reset)
+	r.reset = make(chan struct{})
+}
+
+// execStep executes a step of a [streamer] with [Repl.execCommand].
+func (r *Repl) execStep(ctx context.Context, timeout time.Duration, fn runFunc, encode bool, out io.Writer) (*snapshot, error) {
+	ctx, cancel := r.withTimeout(ctx, timeout)
+	defer cancel()
+	return r.execCommand(ctx, fn, encode, out)
+}
+
+// tick returns the current simulation tick from the callbacks,
+// or the number of calls to [Repl.Poll] if there is no callback.
+// Must only be called by commands executed by [Repl.Poll].
+func (r *Repl) tick() int {
+	if r.callbacks.Ticks != nil {
+		return r.callbacks.Ticks()
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.polls
 }
 
 // System returns a UI system for the usage in applications using [ark-tools].
@@ -224,82 +539,212 @@ func (r *Repl) System() *System {
 	return &r.system
 }
 
-func (r *Repl) handleConnection(conn net.Conn) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	scanner := bufio.NewScanner(conn)
-	writer := bufio.NewWriter(conn)
-
-	if _, err := writer.WriteString("Ark REPL connected. Type 'help' for commands.\n"); err != nil {
-		panic(err)
+// handleCommand parses and executes a command line, using the session's settings.
+// The timeout for the command to be executed overrides the REPL's timeout if positive.
+// Returns the command's result as JSON if withData is true, and false if the session should end.
+// Results are only encoded if they are requested or needed for the session's output format.
+//
+// Output that was not yet forwarded by the output is left for the caller to flush.
+func (r *Repl) handleCommand(ctx context.Context, opts *settings, cmdString string, timeout time.Duration, withData bool, out *output) (json.RawMessage, bool, error) {
+	tokens, err := splitArgs(cmdString)
+	if err != nil {
+		return nil, true, err
 	}
-	if err := writer.Flush(); err != nil {
-		panic(err)
+	tokens, format, err := extractFormat(tokens, opts.format)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(tokens) > 0 && tokens[0] == formatCommand {
+		return nil, true, opts.setFormat(tokens[1:], out)
 	}
 
-	for {
-		if _, err := writer.WriteString(">\n"); err != nil {
-			panic(err)
+	cmd, help, err := parseArgs(tokens, r.commands)
+	if err != nil {
+		return nil, true, err
+	}
+	if help {
+		var text strings.Builder
+		if err := extractHelp(cmd, &text); err != nil {
+			return nil, true, err
 		}
-		if err := writer.Flush(); err != nil {
-			panic(err)
+		_, err := io.WriteString(out, text.String())
+		return nil, true, err
+	}
+	cmdType := reflect.TypeOf(cmd)
+	if cmdType == exitCmd {
+		return nil, false, nil
+	}
+	// Commands without structured results always produce text.
+	// Runners that return no result fall back to their text output.
+	var cmdOut io.Writer = out
+	var text *bytes.Buffer
+	if format != formatText {
+		switch cmd.(type) {
+		case Runner:
+			text = &bytes.Buffer{}
+			cmdOut = text
+		case liveStreamer:
+			// Streamed before the result.
+		case streamer:
+			cmdOut = io.Discard
 		}
+	}
 
-		if !scanner.Scan() {
-			break
+	encode := withData || format != formatText
+	var result *snapshot
+	if s, ok := cmd.(streamer); ok {
+		ctx, stop := opts.interruptible(ctx)
+		defer stop()
+		result, err = s.stream(ctx, timeout, opts.stopHint, encode, cmdOut)
+	} else {
+		ctx, cancel := r.withTimeout(ctx, timeout)
+		defer cancel()
+		result, err = r.execCommand(ctx, cmd, encode, cmdOut)
+	}
+	if err != nil {
+		return nil, !errors.Is(err, ErrClosed), err
+	}
+	if result == nil {
+		if text != nil {
+			_, _ = text.WriteTo(out)
 		}
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+		return nil, true, out.Err()
+	}
+	if format != formatText {
+		if err := render(format, result, out); err != nil {
+			return nil, true, err
 		}
+	}
+	if !withData {
+		return nil, true, out.Err()
+	}
+	if err := out.account(len(result.data)); err != nil {
+		return nil, true, err
+	}
+	return result.data, true, nil
+}
 
-		var out strings.Builder
-		if !r.handleCommand(line, &out) {
-			if _, err := writer.WriteString(out.String()); err != nil {
-				panic(err)
-			}
-			if err := writer.Flush(); err != nil {
-				panic(err)
-			}
-			break
+// withTimeout derives a context that expires with an [ErrTimeout] cause.
+// Uses the REPL's timeout if the given timeout is not positive.
+func (r *Repl) withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = r.commandTimeout()
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	cause := fmt.Errorf("%w: simulation did not poll within %s; it may be blocked or stopped", ErrTimeout, timeout)
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// execCommand queues a command for execution by [Repl.Poll] and waits for it to finish.
+//
+// If the context is done before the command is executed, its cause is returned.
+// This is [ErrClosed] if the REPL was shut down, [ErrTimeout] or [ErrCanceled].
+// Returns [ErrBusy] if the queue is full, and a [*PanicError] if the command panicked.
+// Otherwise, returns the error of the command, and a snapshot of the result if encode is true.
+func (r *Repl) execCommand(ctx context.Context, cmd helper, encode bool, out io.Writer) (result *snapshot, err error) {
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	done := make(chan struct{})
+	task := &queuedTask{}
+	task.run = func() {
+		if !task.state.CompareAndSwap(taskQueued, taskRunning) {
+			// Canceled while queued.
+			return
 		}
-		if _, err := writer.WriteString(out.String()); err != nil {
-			panic(err)
+		wasLocked := r.world.IsLocked()
+		defer func() {
+			if p := recover(); p != nil {
+				err = &PanicError{
+					Value:       p,
+					Stack:       debug.Stack(),
+					WorldLocked: !wasLocked && r.world.IsLocked(),
+				}
+				r.log().Error("REPL command panicked", "command", reflect.TypeOf(cmd).String(), "panic", p)
+			}
+			close(done)
+		}()
+		var value any
+		if value, err = run(cmd, r.world, out); err == nil && encode {
+			result, err = takeSnapshot(value)
 		}
-		if err := writer.Flush(); err != nil {
-			panic(err)
+	}
+
+	if !r.enqueue(task) {
+		return nil, ErrBusy
+	}
+
+	select {
+	case <-done:
+		return result, err
+	case <-ctx.Done():
+		if task.state.CompareAndSwap(taskQueued, taskCanceled) {
+			return nil, context.Cause(ctx)
 		}
+		// Already running, so wait for it to finish.
+		<-done
+		return result, err
 	}
 }
 
-func (r *Repl) handleCommand(cmdString string, out *strings.Builder) bool {
-	cmd, help, err := parseInput(cmdString, r.commands)
-	if err != nil {
-		out.WriteString(err.Error() + "\n")
+// enqueue adds a task to the queue for [Repl.Poll].
+//
+// If the queue is full, tasks that were canceled while queued are removed,
+// so that they don't take up space until the next poll.
+// Returns false if the queue is still full.
+func (r *Repl) enqueue(task *queuedTask) bool {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+
+	select {
+	case r.channel <- task:
 		return true
+	default:
 	}
-	if help {
-		if err := extractHelp(cmd, out); err != nil {
-			panic(err)
+
+	// Only the poll can take tasks in the meantime, so the remaining ones fit back in.
+	var remaining []*queuedTask
+drain:
+	for {
+		select {
+		case t := <-r.channel:
+			if t.state.Load() != taskCanceled {
+				remaining = append(remaining, t)
+			}
+		default:
+			break drain
 		}
-		return true
 	}
-	cmdType := reflect.TypeOf(cmd)
-	if cmdType == exitCmd {
+	for _, t := range remaining {
+		r.channel <- t
+	}
+
+	select {
+	case r.channel <- task:
+		return true
+	default:
 		return false
 	}
-	r.execCommand(cmd, out)
-	return true
 }
 
-func (r *Repl) execCommand(cmd Command, out *strings.Builder) {
-	done := make(chan struct{})
-	r.channel <- func() {
-		cmd.Execute(r.world, out)
-		close(done)
+// PanicError is returned for commands that panicked during execution.
+// The panic is recovered, so the simulation keeps running.
+type PanicError struct {
+	// Value passed to panic.
+	Value any
+	// Stack trace of the panic.
+	Stack []byte
+	// Whether the world was left locked, e.g. by an unclosed query.
+	WorldLocked bool
+}
+
+func (e *PanicError) Error() string {
+	msg := fmt.Sprintf("command panicked: %v", e.Value)
+	if e.WorldLocked {
+		msg += "\nWARNING: the world was left locked by the command"
 	}
-	<-done
+	return msg + "\n\n" + string(e.Stack)
 }
@@ -0,0 +1,1673 @@
+package repl
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/mlange-42/ark-repl/internal/protocol"
+	"github.com/mlange-42/ark/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+type promptCmd struct{}
+
+func (c promptCmd) Execute(_ *ecs.World, out *strings.Builder) {
+	fmt.Fprint(out, "before\n>\nafter\n")
+}
+func (c promptCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Prints a prompt line.")
+}
+
+type panicCmd struct{}
+
+func (c panicCmd) Execute(_ *ecs.World, _ *strings.Builder) {
+	panic("test panic")
+}
+func (c panicCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Panics.")
+}
+
+type sumCmd struct {
+	Values []int `help:"Values to sum up."`
+}
+
+func (c sumCmd) Run(_ *ecs.World, out io.Writer) (any, error) {
+	if len(c.Values) == 0 {
+		return nil, errors.New("no values given")
+	}
+	sum := 0
+	for _, v := range c.Values {
+		sum += v
+	}
+	fmt.Fprintf(out, "Sum: %d\n", sum)
+	return map[string]int{"sum": sum}, nil
+}
+func (c sumCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Sums up values.")
+}
+
+type bytesCmd struct {
+	N int `help:"Number of bytes to write."`
+}
+
+func (c bytesCmd) Run(_ *ecs.World, out io.Writer) (any, error) {
+	for range c.N {
+		if _, err := io.WriteString(out, "x"); err != nil {
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+func (c bytesCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Writes bytes.")
+}
+
+// countWriter counts calls to Write.
+type countWriter struct {
+	bytes  int
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.bytes += len(p)
+	w.writes++
+	return len(p), nil
+}
+
+// newTestRepl creates a REPL with a server and a polling simulation.
+// The configure functions are called before the server is started.
+func newTestRepl(t *testing.T, configure ...func(r *Repl)) (*Repl, string) {
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	assert.Nil(t, r.AddCommand("prompt", promptCmd{}))
+	assert.Nil(t, r.AddCommand("panic", panicCmd{}))
+	assert.Nil(t, r.AddRunner("sum", sumCmd{}))
+	assert.Nil(t, r.AddRunner("bytes", bytesCmd{}))
+	for _, fn := range configure {
+		fn(r)
+	}
+
+	addr := "unix://" + filepath.Join(t.TempDir(), "repl.sock")
+	assert.Nil(t, r.StartServer(addr))
+	t.Cleanup(func() { assert.Nil(t, r.Close()) })
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				r.Poll()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	return r, addr
+}
+
+func dialTest(t *testing.T, addr string) net.Conn {
+	network, address := protocol.ParseAddress(addr)
+	conn, err := net.Dial(network, address)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestServerFramed(t *testing.T) {
+	_, addr := newTestRepl(t)
+	conn := dialTest(t, addr)
+
+	client, err := protocol.NewClient(conn, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Ark REPL connected. Type 'help' for commands.\n", client.Greeting())
+
+	resp, err := client.Exec("prompt")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.Equal(t, "before\n>\nafter\n", resp.Output)
+
+	resp, err = client.Exec("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "unknown command: foo", resp.Error)
+
+	resp, err = client.Exec("exit")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusExit, resp.Status)
+}
+
+func TestServerPlain(t *testing.T) {
+	_, addr := newTestRepl(t)
+	conn := dialTest(t, addr)
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "Ark REPL connected. Type 'help' for commands.\n", line)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, ">\n", line)
+
+	_, err = fmt.Fprintln(conn, "foo")
+	assert.Nil(t, err)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown command: foo\n", line)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, ">\n", line)
+
+	_, err = fmt.Fprintln(conn, "exit")
+	assert.Nil(t, err)
+	_, err = reader.ReadString('\n')
+	assert.NotNil(t, err)
+}
+
+func TestServerLineLimit(t *testing.T) {
+	_, addr := newTestRepl(t)
+	long := strings.Repeat("x", protocol.MaxRequestSize)
+
+	conn := dialTest(t, addr)
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+	}
+	go func() { _, _ = io.WriteString(conn, long+"\n") }()
+	_, err := reader.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	_, err = client.Exec(long)
+	assert.NotNil(t, err)
+}
+
+func TestServerToken(t *testing.T) {
+	_, addr := newTestRepl(t, func(r *Repl) { r.SetToken("secret") })
+
+	conn := dialTest(t, addr)
+	_, err := protocol.NewClient(conn, "wrong")
+	assert.Equal(t, "handshake rejected: authentication failed", err.Error())
+
+	conn = dialTest(t, addr)
+	client, err := protocol.NewClient(conn, "secret")
+	assert.Nil(t, err)
+	resp, err := client.Exec("prompt")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+
+	conn = dialTest(t, addr)
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	_, err = fmt.Fprintln(conn, "auth secret")
+	assert.Nil(t, err)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, ">\n", line)
+
+	conn = dialTest(t, addr)
+	reader = bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	_, err = fmt.Fprintln(conn, "stats")
+	assert.Nil(t, err)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "authentication failed; send 'auth <token>' as first line\n", line)
+}
+
+// newTestCert creates a self-signed certificate for localhost, as PEM.
+func newTestCert(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestServerTLS(t *testing.T) {
+	certPEM, keyPEM := newTestCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, certPEM, 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(certPEM))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	t.Cleanup(func() { assert.Nil(t, r.Close()) })
+	assert.NotNil(t, r.StartServerTLS("unix://"+filepath.Join(dir, "fail.sock"), certFile, filepath.Join(dir, "missing.pem")))
+
+	path := filepath.Join(dir, "repl.sock")
+	assert.Nil(t, r.StartServerTLS("unix://"+path, certFile, keyFile))
+	configPath := filepath.Join(dir, "config.sock")
+	assert.Nil(t, r.StartServerTLSConfig("unix://"+configPath, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	for _, p := range []string{path, configPath} {
+		conn, err := tls.Dial("unix", p, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		client, err := protocol.NewClient(conn, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "Ark REPL connected. Type 'help' for commands.\n", client.Greeting())
+
+		// Unknown certificate authority.
+		_, err = tls.Dial("unix", p, &tls.Config{ServerName: "localhost"})
+		var unknownAuthority x509.UnknownAuthorityError
+		assert.ErrorAs(t, err, &unknownAuthority)
+
+		// Wrong host name.
+		_, err = tls.Dial("unix", p, &tls.Config{RootCAs: pool, ServerName: "example.com"})
+		var invalidHost x509.HostnameError
+		assert.ErrorAs(t, err, &invalidHost)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repl.sock")
+	addr := "unix://" + path
+
+	ln, err := listen(addr)
+	assert.Nil(t, err)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = listen(addr)
+	assert.NotNil(t, err)
+
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.Nil(t, ln.Close())
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	ln, err = listen(addr)
+	assert.Nil(t, err)
+	assert.Nil(t, ln.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShutdown(t *testing.T) {
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	addr := "unix://" + filepath.Join(t.TempDir(), "repl.sock")
+	assert.Nil(t, r.StartServer(addr))
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	// Nobody polls, so the command blocks until shutdown.
+	result := make(chan protocol.Message)
+	go func() {
+		resp, _ := client.Exec("stats")
+		result <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Nil(t, r.Close())
+	resp := <-result
+	assert.Equal(t, protocol.StatusExit, resp.Status)
+	assert.Equal(t, ErrClosed.Error(), resp.Error)
+
+	_, err = os.Stat(strings.TrimPrefix(addr, "unix://"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Restart and shut down an idle session.
+	assert.Nil(t, r.StartServer(addr))
+	client, err = protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+
+	_, err = client.Exec("stats")
+	assert.Equal(t, "closed by server: "+shutdownMessage, err.Error())
+}
+
+func TestFrontends(t *testing.T) {
+	input, inputWriter := io.Pipe()
+	stdin = newLineReader(input)
+	t.Cleanup(func() { stdin = newLineReader(os.Stdin) })
+
+	r, addr := newTestRepl(t)
+	assert.Nil(t, r.Start())
+	assert.Equal(t, ErrStarted, r.Start())
+
+	addr2 := "unix://" + filepath.Join(t.TempDir(), "repl2.sock")
+	assert.Nil(t, r.StartServer(addr2))
+	err := r.StartServer(addr)
+	assert.Contains(t, err.Error(), "already in use")
+
+	for _, a := range []string{addr, addr2} {
+		client, err := protocol.NewClient(dialTest(t, a), "")
+		assert.Nil(t, err)
+		resp, err := client.Exec("prompt")
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.StatusOk, resp.Status)
+	}
+
+	// The terminal REPL can be restarted after it was exited.
+	_, err = fmt.Fprintln(inputWriter, "exit")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return r.Start() == nil }, time.Second, time.Millisecond)
+}
+
+func TestPanic(t *testing.T) {
+	r, addr := newTestRepl(t, func(r *Repl) { r.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil))) })
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec("panic")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.True(t, strings.HasPrefix(resp.Error, "command panicked: test panic\n"))
+	assert.Contains(t, resp.Error, "panicCmd.Execute")
+
+	resp, err = client.Exec("query n=0")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.Equal(t, "Listed 0 of 0 entities\n", resp.Output)
+	assert.False(t, r.world.IsLocked())
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	// Nobody polls in this test.
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	r.SetTimeout(20 * time.Millisecond)
+	addr := "unix://" + filepath.Join(t.TempDir(), "repl.sock")
+	assert.Nil(t, r.StartServer(addr))
+	t.Cleanup(func() { assert.Nil(t, r.Close()) })
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec("stats")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "repl: timeout: simulation did not poll within 20ms; it may be blocked or stopped", resp.Error)
+
+	// The timeout can be changed while the server is running.
+	r.SetTimeout(10 * time.Millisecond)
+	resp, err = client.Exec("stats")
+	assert.Nil(t, err)
+	assert.Equal(t, "repl: timeout: simulation did not poll within 10ms; it may be blocked or stopped", resp.Error)
+
+	client.SetTimeout(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	resp, err = client.ExecContext(ctx, "stats")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, ErrCanceled.Error(), resp.Error)
+
+	// The session is still usable.
+	client.SetTimeout(0)
+	resp, err = client.Exec("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown command: foo", resp.Error)
+}
+
+type countCmd struct {
+	count *int
+}
+
+func (c countCmd) Execute(_ *ecs.World, _ *strings.Builder) {
+	*c.count++
+	time.Sleep(time.Millisecond)
+}
+func (c countCmd) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Counts calls.")
+}
+
+func TestQueue(t *testing.T) {
+	// Nobody polls in this test.
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	r.SetQueueSize(1)
+	addr := "unix://" + filepath.Join(t.TempDir(), "repl.sock")
+	assert.Nil(t, r.StartServer(addr))
+	t.Cleanup(func() { assert.Nil(t, r.Close()) })
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	client.SetTimeout(50 * time.Millisecond)
+	result := make(chan protocol.Message)
+	go func() {
+		resp, _ := client.Exec("stats")
+		result <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client2, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	resp, err := client2.Exec("stats")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusBusy, resp.Status)
+	assert.Equal(t, ErrBusy.Error(), resp.Error)
+
+	// Timed out commands don't take up space in the queue.
+	resp = <-result
+	assert.Contains(t, resp.Error, "repl: timeout")
+	client2.SetTimeout(50 * time.Millisecond)
+	resp, err = client2.Exec("stats")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Contains(t, resp.Error, "repl: timeout")
+}
+
+func TestPollBudget(t *testing.T) {
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{})
+	r.SetQueueSize(5)
+	r.SetPollBudget(time.Nanosecond)
+
+	count := 0
+	errs := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := r.execCommand(context.Background(), countCmd{&count}, false, &strings.Builder{})
+			errs <- err
+		}()
+	}
+	assert.Eventually(t, func() bool { return len(r.channel) == 5 }, time.Second, time.Millisecond)
+
+	r.Poll()
+	assert.Equal(t, 1, count)
+	assert.Nil(t, <-errs)
+
+	r.SetPollBudget(0)
+	r.Poll()
+	assert.Equal(t, 5, count)
+	for range 4 {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	r, addr := newTestRepl(t)
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	assert.NotNil(t, r.AddRunner("sum", sumCmd{}))
+
+	// Data is only sent if requested.
+	resp, err := client.Exec("sum values=1,2,3")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.Equal(t, "Sum: 6\n", resp.Output)
+	assert.Empty(t, resp.Data)
+	resp, err = client.Exec("sum values=1,2,3 format=json")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"sum": 6}`, resp.Output)
+	assert.Empty(t, resp.Data)
+
+	client.SetWithData(true)
+	resp, err = client.Exec("sum values=1,2,3")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.Equal(t, "Sum: 6\n", resp.Output)
+	assert.JSONEq(t, `{"sum": 6}`, string(resp.Data))
+
+	resp, err = client.Exec("sum")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "no values given", resp.Error)
+	assert.Empty(t, resp.Data)
+
+	resp, err = client.Exec("query comps=Foo")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+
+	resp, err = client.Exec("query")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.JSONEq(t, `{"total": 0, "page": 0, "pages": 0, "entities": []}`, string(resp.Data))
+
+	resp, err = client.Exec("help sum")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Output, "Sums up values.")
+}
+
+func TestStreamOutput(t *testing.T) {
+	_, addr := newTestRepl(t)
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	out := countWriter{}
+	size := 3*chunkSize + 10
+	resp, err := client.ExecStream(context.Background(), fmt.Sprintf("bytes n=%d", size), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status)
+	assert.Empty(t, resp.Output)
+	assert.Equal(t, size, out.bytes)
+	assert.Equal(t, 4, out.writes)
+
+	resp, err = client.Exec("bytes n=10")
+	assert.Nil(t, err)
+	assert.Equal(t, "xxxxxxxxxx", resp.Output)
+
+	_, addr = newTestRepl(t, func(r *Repl) { r.SetOutputLimit(chunkSize + 5) })
+	client, err = protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	resp, err = client.Exec(fmt.Sprintf("bytes n=%d", size))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, chunkSize+5, len(resp.Output))
+	assert.Equal(t, fmt.Sprintf("repl: output limit exceeded: output truncated after %d bytes", chunkSize+5), resp.Error)
+
+	conn := dialTest(t, addr)
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+	}
+	_, err = fmt.Fprintf(conn, "bytes n=%d\n", size)
+	assert.Nil(t, err)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("x", chunkSize+5)+resp.Error+"\n", line)
+
+	// The encoded result counts against the limit, and commands stop writing.
+	r, addr := newTestRepl(t, func(r *Repl) { r.SetOutputLimit(100) })
+	mapper := ecs.NewMap1[position](r.world)
+	for i := range 20 {
+		mapper.NewEntity(&position{float64(i), 0})
+	}
+	client, err = protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	client.SetWithData(true)
+	resp, err = client.Exec("sum values=1,2,3")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp, err = client.Exec("query comps=repl.position n=2")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "repl: output limit exceeded: result of 159 bytes not sent", resp.Error)
+	assert.Empty(t, resp.Data)
+	resp, err = client.Exec("query comps=repl.position n=20")
+	assert.Nil(t, err)
+	assert.Equal(t, "repl: output limit exceeded: output truncated after 100 bytes", resp.Error)
+	assert.Equal(t, 100, len(resp.Output))
+	assert.Empty(t, resp.Data)
+}
+
+type position struct {
+	X, Y float64
+}
+
+func TestFormats(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	mapper.NewEntity(&position{1, 2})
+	mapper.NewEntity(&position{3, 4.5})
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec("query comps=repl.position format=table")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "entity  components.position.X  components.position.Y\n"+
+		"[2,0]   1                      2\n"+
+		"[3,0]   3                      4.5\n", resp.Output)
+
+	resp, err = client.Exec("list components format=csv")
+	assert.Nil(t, err)
+	assert.Equal(t, "id,type\n0,repl.position\n", resp.Output)
+
+	resp, err = client.Exec("list components format=yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "- id: 0\n  type: repl.position\n", resp.Output)
+
+	resp, err = client.Exec("stats format=table")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Output, "Entities.Used      2\n")
+
+	resp, err = client.Exec("format json")
+	assert.Nil(t, err)
+	assert.Equal(t, "Output format set to json\n", resp.Output)
+	resp, err = client.Exec("shrink")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Output, "{\n  \"before\": ")
+	resp, err = client.Exec("shrink format=text")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Output, "Shrink")
+
+	// Commands without structured results produce text.
+	resp, err = client.Exec("prompt")
+	assert.Nil(t, err)
+	assert.Equal(t, "before\n>\nafter\n", resp.Output)
+	resp, err = client.Exec("help")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Output, "Commands:")
+
+	resp, err = client.Exec("format foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown format 'foo'; available formats: text, table, json, csv, yaml", resp.Error)
+	resp, err = client.Exec("format")
+	assert.Nil(t, err)
+	assert.Equal(t, "Output format: json\n", resp.Output)
+
+	// The default format is per session.
+	client2, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	resp, err = client2.Exec("format")
+	assert.Nil(t, err)
+	assert.Equal(t, "Output format: text\n", resp.Output)
+}
+
+func TestNonFiniteResults(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	mapper.NewEntity(&position{math.NaN(), math.Inf(1)})
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec("query comps=repl.position")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{2 0}: position{X:NaN Y:+Inf}\nListed 1 of 1 entities (page 0 of 1)\n", resp.Output)
+
+	resp, err = client.Exec("query comps=repl.position format=table")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "entity  components.position.X  components.position.Y\n"+
+		"[2,0]   NaN                    +Inf\n", resp.Output)
+
+	client.SetWithData(true)
+	resp, err = client.Exec("agg fields=position.X")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Contains(t, string(resp.Data), `"NaN"`)
+}
+
+func TestQueryWhere(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	for i := range 10 {
+		mapper.NewEntity(&position{float64(i), 0})
+	}
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`query where="position.X >= 2 && position.X < 8" n=4 page=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{8 0}: position{X:6 Y:0}\n{9 0}: position{X:7 Y:0}\n"+
+		"Listed 2 of 6 entities (page 1 of 2)\n", resp.Output)
+
+	resp, err = client.Exec(`query where="position.X > 'a'"`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "invalid filter: cannot compare number 'position.X' with string 'a' at position 12", resp.Error)
+}
+
+func TestQuerySortFields(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	for i := range 6 {
+		mapper.NewEntity(&position{float64(i % 3), float64(i)})
+	}
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`query sort="position.X desc, position.Y" fields=position.Y n=4`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{4 0}: position.Y=2\n{7 0}: position.Y=5\n{3 0}: position.Y=1\n{6 0}: position.Y=4\n"+
+		"Listed 4 of 6 entities (page 0 of 2)\n", resp.Output)
+
+	resp, err = client.Exec(`query sort=position.X where="position.Y > 0" fields=position n=2 page=1 format=csv`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "entity,components.position.X,components.position.Y\n\"[6,0]\",1,4\n\"[4,0]\",2,2\n", resp.Output)
+
+	resp, err = client.Exec(`query sort="position.X up"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid sort order 'up'; expected 'asc' or 'desc'", resp.Error)
+}
+
+func TestAgg(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	for i := range 6 {
+		mapper.NewEntity(&position{float64(i % 3), float64(i)})
+	}
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`agg fields=position.X,position.Y quantiles=0.5`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "field       count  distinct  sum  mean  std       min  max  p50\n"+
+		"position.X  6      3         6    1     0.894427  0    2    1\n"+
+		"position.Y  6      6         15   2.5   1.87083   0    5    2.5\n", resp.Output)
+
+	resp, err = client.Exec(`agg fields=position.Y by=position.X where="position.Y > 0" quantiles=0.25 format=csv`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "group,field,count,distinct,sum,mean,std,min,max,p25\n"+
+		"1,position.Y,2,2,5,2.5,2.1213203435596424,1,4,1.75\n"+
+		"2,position.Y,2,2,7,3.5,2.1213203435596424,2,5,2.75\n"+
+		"0,position.Y,1,1,3,3,0,3,3,3\n", resp.Output)
+
+	resp, err = client.Exec(`agg fields=position.Y by=archetype quantiles=0.5`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "group       field       count  distinct  sum  mean  std      min  max  p50\n"+
+		"[position]  position.Y  6      6         15   2.5   1.87083  0    5    2.5\n", resp.Output)
+
+	resp, err = client.Exec(`agg`)
+	assert.Nil(t, err)
+	assert.Equal(t, "no fields given; use fields=<Component.Field>,...", resp.Error)
+
+	resp, err = client.Exec(`agg fields=position.X quantiles=2`)
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid quantile 2; must be between 0 and 1", resp.Error)
+}
+
+func TestAggValues(t *testing.T) {
+	values := aggValues{}
+	for _, s := range []string{"a", "b", "a"} {
+		values.add(kindString, reflect.ValueOf(s))
+	}
+	row := values.aggregate([]float64{0.5})
+	assert.Equal(t, 3, row.Count)
+	assert.Equal(t, 2, row.Distinct)
+	assert.False(t, row.numeric)
+
+	assert.Equal(t, 2.5, quantile([]float64{1, 2, 3, 4}, 0.5))
+	assert.Equal(t, 1.0, quantile([]float64{1, 2, 3, 4}, 0))
+	assert.Equal(t, "p2.5", quantileName(0.025))
+}
+
+func TestHistPlot(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	for i := range 6 {
+		mapper.NewEntity(&position{float64(i % 3), float64(i)})
+	}
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`hist field=position.Y bins=2 width=4`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "position.Y (6 entities)\n"+
+		"[0, 2.5)  3  ████\n"+
+		"[2.5, 5]  3  ████\n", resp.Output)
+
+	resp, err = client.Exec(`hist field=position.Y bins=3 where="position.X == 0" format=csv`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "min,max,count\n0,1,1\n1,2,0\n2,3,1\n", resp.Output)
+
+	resp, err = client.Exec(`plot x=position.X y=position.Y width=6 height=3`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "position.Y vs. position.X (6 entities)\n"+
+		"5 │   ⠄ ⠈\n"+
+		"  │⠁    ⢀\n"+
+		"0 │⡀  ⠂  \n"+
+		"  └──────\n"+
+		"   0    2\n", resp.Output)
+
+	resp, err = client.Exec(`plot x=position.X`)
+	assert.Nil(t, err)
+	assert.Equal(t, "no fields given; use x=<Component.Field> y=<Component.Field>", resp.Error)
+
+	resp, err = client.Exec(`hist field=position`)
+	assert.Nil(t, err)
+	assert.Equal(t, "can't plot 'position' of type repl.position; only numeric fields are supported", resp.Error)
+}
+
+func TestHistPlotLargeRange(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	mapper.NewEntity(&position{-math.MaxFloat64, math.MaxFloat64})
+	mapper.NewEntity(&position{math.MaxFloat64, -math.MaxFloat64})
+	mapper.NewEntity(&position{0, 0})
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`hist field=position.X bins=2 format=csv`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "min,max,count\n-1.7976931348623157e+308,0,1\n0,1.7976931348623157e+308,2\n", resp.Output)
+
+	resp, err = client.Exec(`plot x=position.X y=position.Y width=3 height=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Contains(t, resp.Output, "│⠁⠐⢀\n")
+}
+
+func TestScaleIndex(t *testing.T) {
+	assert.Equal(t, 0, scaleIndex(0, 0, 10, 5))
+	assert.Equal(t, 2, scaleIndex(5, 0, 10, 5))
+	assert.Equal(t, 4, scaleIndex(10, 0, 10, 5))
+	assert.Equal(t, 4, scaleIndex(1e308, -1e308, 1e308, 5))
+	assert.Equal(t, 0, scaleIndex(1e308, 1e308, 1e308, 5))
+}
+
+func TestBar(t *testing.T) {
+	assert.Equal(t, "████", bar(10, 10, 4))
+	assert.Equal(t, "██▌", bar(5, 8, 4))
+	assert.Equal(t, "▏", bar(1, 1000, 4))
+	assert.Equal(t, "", bar(0, 10, 4))
+}
+
+type childOf struct {
+	ecs.RelationMarker
+	Order int
+}
+
+type agentInfo struct {
+	Name  string
+	Inner struct{ A, B int }
+}
+
+func TestEntityCmd(t *testing.T) {
+	r, addr := newTestRepl(t)
+	parent := r.world.NewEntity()
+	mapper := ecs.NewMap3[position, agentInfo, childOf](r.world)
+	child := mapper.NewEntity(&position{1, 2}, &agentInfo{Name: "a"}, &childOf{Order: 3}, ecs.Rel[childOf](parent))
+	dead := r.world.NewEntity()
+	r.world.RemoveEntity(dead)
+	recycled := r.world.NewEntity()
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(fmt.Sprintf("entity %d", child.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Entity {3 0} (alive)\n"+
+		"Archetype: [position agentInfo childOf]\n"+
+		"Components:\n"+
+		"  position:\n    X: 1\n    Y: 2\n"+
+		"  agentInfo:\n    Name: a\n    Inner:\n      A: 0\n      B: 0\n"+
+		"  childOf:\n    Order: 3\n"+
+		"Relations:\n"+
+		"  childOf -> {2 0}\n", resp.Output)
+
+	resp, err = client.Exec(fmt.Sprintf("entity %d.0 format=json", parent.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Contains(t, resp.Output, `"referencedBy": [
+    {
+      "entity": [
+        3,
+        0
+      ],
+      "relation": "childOf"
+    }
+  ]`)
+
+	resp, err = client.Exec(fmt.Sprintf("entity %d.0", recycled.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, "entity {4 0} is dead; ID 4 was recycled as {4 1}", resp.Error)
+
+	r.world.RemoveEntity(recycled)
+	resp, err = client.Exec(fmt.Sprintf("entity entity=%d", recycled.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, "entity ID 4 is currently not in use", resp.Error)
+	// The free ID holds the generation of its next use.
+	resp, err = client.Exec(fmt.Sprintf("entity %d.2", recycled.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, "entity {4 2} is dead; ID 4 is currently not in use", resp.Error)
+
+	resp, err = client.Exec("entity 100")
+	assert.Nil(t, err)
+	assert.Equal(t, "entity 100 does not exist", resp.Error)
+
+	resp, err = client.Exec("entity x")
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid entity 'x'; expected <id>[.<gen>]", resp.Error)
+}
+
+func TestSet(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap1[position](r.world)
+	entities := []ecs.Entity{}
+	for i := range 4 {
+		entities = append(entities, mapper.NewEntity(&position{float64(i), 0}))
+	}
+	infoMapper := ecs.NewMap2[agentInfo, childOf](r.world)
+	agent := infoMapper.NewEntity(&agentInfo{}, &childOf{}, ecs.Rel[childOf](entities[0]))
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(fmt.Sprintf(`set %d position.X=10 position.Y=-1.5`, entities[1].ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Set 2 field(s) of entity {3 0}\n", resp.Output)
+	assert.Equal(t, position{10, -1.5}, *mapper.Get(entities[1]))
+
+	resp, err = client.Exec(`set position.Y=7 where="position.X < 10" format=json`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{\n  \"count\": 3\n}\n", resp.Output)
+	assert.Equal(t, position{3, 7}, *mapper.Get(entities[3]))
+	assert.Equal(t, position{10, -1.5}, *mapper.Get(entities[1]))
+
+	resp, err = client.Exec(fmt.Sprintf(`set entity=%d "agentInfo.Name=a b" agentInfo.Inner.A=3 childOf.Order=%d`, agent.ID(), 2))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	info, rel := infoMapper.Get(agent)
+	assert.Equal(t, "a b", info.Name)
+	assert.Equal(t, 3, info.Inner.A)
+	assert.Equal(t, 2, rel.Order)
+
+	resp, err = client.Exec(fmt.Sprintf(`set %d agentInfo.Name=x`, entities[0].ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, "entity {2 0} has no component agentInfo", resp.Error)
+
+	resp, err = client.Exec(`set position.X=abc`)
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid value for number field 'position.X': abc", resp.Error)
+
+	resp, err = client.Exec(`set position=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, "can't set 'position' of type repl.position; only numbers, strings, bools and entities are supported", resp.Error)
+
+	resp, err = client.Exec(`set 2 position.X=1 where="position.X > 0"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "can't use filters together with an entity", resp.Error)
+}
+
+func TestParseValue(t *testing.T) {
+	type state string
+	w := ecs.NewWorld()
+	e := w.NewEntity()
+
+	v, err := parseValue(&w, reflect.TypeFor[state](), "s", "hungry")
+	assert.Nil(t, err)
+	assert.Equal(t, state("hungry"), v.Interface())
+
+	v, err = parseValue(&w, reflect.TypeFor[ecs.Entity](), "e", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, e, v.Interface())
+
+	_, err = parseValue(&w, reflect.TypeFor[int8](), "i", "300")
+	assert.Equal(t, "invalid value for number field 'i': 300", err.Error())
+
+	_, err = parseValue(&w, reflect.TypeFor[bool](), "b", "yes")
+	assert.Equal(t, "invalid value for bool field 'b': yes", err.Error())
+}
+
+// entityAt returns the alive entity with the given ID.
+func entityAt(t *testing.T, world *ecs.World, id uint32) ecs.Entity {
+	entity, err := resolveEntity(world, fmt.Sprint(id))
+	assert.Nil(t, err)
+	return entity
+}
+
+func TestSpawnDespawn(t *testing.T) {
+	r, addr := newTestRepl(t)
+	posMap := ecs.NewMap1[position](r.world)
+	ecs.ComponentID[agentInfo](r.world)
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`spawn n=3 comps=agentInfo position.X=2 position.Y=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Created 3 entities, {2 0} to {4 0}\n", resp.Output)
+	filter := ecs.NewFilter2[position, agentInfo](r.world)
+	query := filter.Query()
+	assert.Equal(t, 3, query.Count())
+	query.Close()
+
+	resp, err = client.Exec(`spawn agentInfo.Name=x format=json`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{\n  \"count\": 1,\n  \"entities\": [\n    [\n      5,\n      0\n    ]\n  ]\n}\n", resp.Output)
+
+	resp, err = client.Exec(`comp add 5 position.X=7`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Added 1 component(s) to 1 entities\n", resp.Output)
+	assert.Equal(t, position{7, 0}, *posMap.Get(entityAt(t, r.world, 5)))
+
+	resp, err = client.Exec(`comp add 5 comps=repl.position`)
+	assert.Nil(t, err)
+	assert.Equal(t, "entity {5 0} already has component position", resp.Error)
+
+	resp, err = client.Exec(`comp remove comps=repl.agentInfo where="position.X == 2"`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Removed 1 component(s) from 3 entities\n", resp.Output)
+	query = filter.Query()
+	assert.Equal(t, 1, query.Count())
+	query.Close()
+
+	resp, err = client.Exec(`despawn`)
+	assert.Nil(t, err)
+	assert.Equal(t, "no entity or filter given; use despawn <id>[.<gen>] or filter options like with=<Component>", resp.Error)
+
+	resp, err = client.Exec(`despawn 3.0`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Removed 1 entities\n", resp.Output)
+
+	resp, err = client.Exec(`despawn comps=repl.position`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Removed 3 entities\n", resp.Output)
+	assert.Equal(t, 0, r.world.Stats().Entities.Used)
+}
+
+type gridRes struct {
+	Width  int
+	Height int
+	Origin position
+}
+
+func TestResource(t *testing.T) {
+	r, addr := newTestRepl(t)
+	grid := &gridRes{Width: 10, Height: 5}
+	ecs.AddResource(r.world, grid)
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`resource get gridRes`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "repl.gridRes:\n  Width: 10\n  Height: 5\n  Origin:\n    X: 0\n    Y: 0\n", resp.Output)
+
+	resp, err = client.Exec(`resource set repl.gridRes Width=20 Origin.Y=1.5 format=json`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, gridRes{Width: 20, Height: 5, Origin: position{0, 1.5}}, *grid)
+	assert.Contains(t, resp.Output, `"type": "repl.gridRes"`)
+
+	resp, err = client.Exec(`resource set gridRes Width=1 Height=x`)
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid value for number field 'Height': x", resp.Error)
+	assert.Equal(t, 20, grid.Width)
+
+	resp, err = client.Exec(`resource set gridRes Depth=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, "Depth: type repl.gridRes has no exported field 'Depth'; available: Width, Height, Origin", resp.Error)
+
+	resp, err = client.Exec(`resource get Grid`)
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown resource type 'Grid'; available: repl.gridRes", resp.Error)
+}
+
+func TestRelations(t *testing.T) {
+	r, addr := newTestRepl(t)
+	mapper := ecs.NewMap2[position, childOf](r.world)
+	root := r.world.NewEntity()
+	a := mapper.NewEntity(&position{1, 0}, &childOf{}, ecs.Rel[childOf](root))
+	mapper.NewEntity(&position{2, 0}, &childOf{}, ecs.Rel[childOf](root))
+	mapper.NewEntity(&position{3, 0}, &childOf{}, ecs.Rel[childOf](a))
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(fmt.Sprintf(`query rel=childOf:%d comps=repl.childOf`, root.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{3 0}: childOf{RelationMarker:{} Order:0}->{2 0}\n"+
+		"{4 0}: childOf{RelationMarker:{} Order:0}->{2 0}\n"+
+		"Listed 2 of 2 entities (page 0 of 1)\n", resp.Output)
+
+	resp, err = client.Exec(fmt.Sprintf(`agg fields=position.X rel=childOf:%d quantiles=0.5`, a.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "field       count  distinct  sum  mean  std  min  max  p50\n"+
+		"position.X  1      1         3    3     0    3    3    3\n", resp.Output)
+
+	resp, err = client.Exec(`tree childOf fields=position.X`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{2 0}\n"+
+		"├─ {3 0} position.X=1\n"+
+		"│  └─ {5 0} position.X=3\n"+
+		"└─ {4 0} position.X=2\n", resp.Output)
+
+	resp, err = client.Exec(fmt.Sprintf(`tree childOf root=%d depth=1`, a.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{3 0} (+1 children)\n", resp.Output)
+
+	resp, err = client.Exec(`tree childOf format=json`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Contains(t, resp.Output, `"children": [`)
+
+	resp, err = client.Exec(`tree position`)
+	assert.Nil(t, err)
+	assert.Equal(t, "component repl.position is not a relation", resp.Error)
+
+	// Cycles without a root are shown, starting at an entity of the cycle.
+	relMap := ecs.NewMap[childOf](r.world)
+	x := relMap.NewEntity(&childOf{}, root)
+	y := relMap.NewEntity(&childOf{}, x)
+	relMap.NewEntity(&childOf{}, y)
+	relMap.SetRelation(x, y)
+	resp, err = client.Exec(`tree childOf`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{2 0}\n"+
+		"├─ {3 0}\n"+
+		"│  └─ {5 0}\n"+
+		"└─ {4 0}\n"+
+		"{6 0}\n"+
+		"└─ {7 0}\n"+
+		"   ├─ {8 0}\n"+
+		"   └─ {6 0} (cycle)\n", resp.Output)
+
+	resp, err = client.Exec(`query rel=childOf`)
+	assert.Nil(t, err)
+	assert.Equal(t, "invalid relation 'childOf'; expected <Component>:<id>[.<gen>]", resp.Error)
+}
+
+func TestSaveLoad(t *testing.T) {
+	r, addr := newTestRepl(t)
+	grid := &gridRes{Width: 10, Height: 5}
+	ecs.AddResource(r.world, grid)
+	mapper := ecs.NewMap2[position, childOf](r.world)
+	root := r.world.NewEntity()
+	mapper.NewEntity(&position{1, 2}, &childOf{Order: 1}, ecs.Rel[childOf](root))
+	removed := r.world.NewEntity()
+	r.world.RemoveEntity(removed)
+	// A cached filter of the simulation, which is invalidated by loading.
+	ecs.NewFilter1[position](r.world).Register()
+	file := filepath.Join(t.TempDir(), "world.json")
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`save ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, fmt.Sprintf("Saved 2 entities and 1 resources to %s\n", file), resp.Output)
+
+	resp, err = client.Exec(`spawn n=3 repl.position.X=5`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp, err = client.Exec(`resource set gridRes Width=20`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+
+	resp, err = client.Exec(`load ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, "the world has 0 observers and 1 cached filters, which would be removed by loading; "+
+		"the simulation may not work correctly afterwards. Use force=true to load anyway", resp.Error)
+	assert.Equal(t, 20, grid.Width)
+
+	resp, err = client.Exec(`load ` + file + ` force=true`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, fmt.Sprintf("Loaded 2 entities and 1 resources from %s\n", file), resp.Output)
+	assert.Equal(t, 10, grid.Width)
+
+	resp, err = client.Exec(`query comps=repl.position,repl.childOf`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "{3 0}: position{X:1 Y:2} childOf{RelationMarker:{} Order:1}->{2 0}\n"+
+		"Listed 1 of 1 entities (page 0 of 1)\n", resp.Output)
+
+	// The removed entity's ID is recycled with the next generation.
+	resp, err = client.Exec(`spawn`)
+	assert.Nil(t, err)
+	assert.Equal(t, "Created entity {4 1}\n", resp.Output)
+
+	resp, err = client.Exec(`load ` + filepath.Join(t.TempDir(), "missing.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+
+	world := ecs.NewWorld()
+	snap, err := readSnapshot(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown component type repl.childOf; it must be registered in the world", snap.restore(&world).Error())
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	world := ecs.NewWorld()
+	posMap := ecs.NewMap1[position](&world)
+	a := posMap.NewEntity(&position{1, 2})
+	world.RemoveEntity(posMap.NewEntity(&position{}))
+	valid, err := takeWorldSnapshot(&world)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		modify func(s *worldSnapshot)
+		err    string
+	}{
+		{func(s *worldSnapshot) { s.Pool = ecs.EntityDump{Entities: []ecs.Entity{}} },
+			"invalid snapshot: entity pool has 0 entries, expected at least 2"},
+		{func(s *worldSnapshot) { s.Entities = append(s.Entities, s.Entities[0]) },
+			"invalid snapshot: duplicate entity {2 0}"},
+		{func(s *worldSnapshot) { s.Pool.Alive = append(s.Pool.Alive, s.Pool.Alive[0]) },
+			"invalid snapshot: entity 2 is alive twice"},
+		{func(s *worldSnapshot) { s.Pool.Entities[2] = newEntity(3, 0) },
+			"invalid snapshot: alive entity 2 has ID 3"},
+		{func(s *worldSnapshot) { s.Pool.Available = 0 },
+			"invalid snapshot: 0 entities available, but 1 are dead"},
+		{func(s *worldSnapshot) { s.Pool.Next = 2 },
+			"invalid snapshot: broken free list of dead entities at 2"},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(valid)
+		assert.Nil(t, err)
+		snap := worldSnapshot{}
+		assert.Nil(t, json.Unmarshal(data, &snap))
+		tt.modify(&snap)
+		err = snap.restore(&world)
+		assert.NotNil(t, err)
+		if err != nil {
+			assert.Equal(t, tt.err, err.Error())
+		}
+		// The world is unchanged.
+		assert.True(t, world.Alive(a))
+		assert.Equal(t, position{1, 2}, *posMap.Get(a))
+	}
+
+	assert.Nil(t, valid.restore(&world))
+	assert.True(t, world.Alive(a))
+	assert.Equal(t, "{3 1}", fmt.Sprint(world.NewEntity()))
+}
+
+func TestSaveNonFinite(t *testing.T) {
+	r, addr := newTestRepl(t)
+	posMap := ecs.NewMap1[position](r.world)
+	posMap.NewEntity(&position{math.NaN(), math.Inf(1)})
+	posMap.NewEntity(&position{math.Inf(-1), 1})
+	file := filepath.Join(t.TempDir(), "world.json")
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`save ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `{"X":"NaN","Y":"+Inf"}`)
+
+	resp, err = client.Exec(`set 3 repl.position.X=0`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp, err = client.Exec(`diff ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Contains(t, resp.Output, "-Inf")
+
+	resp, err = client.Exec(`load ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp, err = client.Exec(`query comps=repl.position`)
+	assert.Nil(t, err)
+	assert.Equal(t, "{2 0}: position{X:NaN Y:+Inf}\n{3 0}: position{X:-Inf Y:1}\n"+
+		"Listed 2 of 2 entities (page 0 of 1)\n", resp.Output)
+}
+
+func TestDiff(t *testing.T) {
+	r, addr := newTestRepl(t)
+	ecs.ComponentID[agentInfo](r.world)
+	posMap := ecs.NewMap1[position](r.world)
+	a := posMap.NewEntity(&position{1, 2})
+	b := posMap.NewEntity(&position{3, 4})
+	posMap.NewEntity(&position{5, 6})
+	ecs.NewMap2[position, childOf](r.world).NewEntity(&position{}, &childOf{}, ecs.Rel[childOf](a))
+	file := filepath.Join(t.TempDir(), "world.json")
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	resp, err := client.Exec(`save ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+
+	for _, cmd := range []string{
+		`set 2 repl.position.X=10`,
+		`despawn 4`,
+		`spawn repl.position.Y=1`,
+		fmt.Sprintf(`comp add %d repl.agentInfo.Name=bob`, b.ID()),
+		`comp remove 5 comps=repl.childOf`,
+	} {
+		resp, err = client.Exec(cmd)
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	}
+
+	resp, err = client.Exec(`diff ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "+ {4 1} [position]\n"+
+		"- {4 0} [position]\n"+
+		"~ {2 0}\n"+
+		"    position.X: 1 -> 10\n"+
+		"~ {3 0}\n"+
+		"    + agentInfo\n"+
+		"~ {5 0}\n"+
+		"    - childOf\n"+
+		"Created 1, removed 1, changed 3 entities\n", resp.Output)
+
+	resp, err = client.Exec(`diff ` + file + ` comps=repl.agentInfo format=table`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "entity  change      field      old  new\n"+
+		"[3,0]   comp added  agentInfo       \n", resp.Output)
+
+	resp, err = client.Exec(`diff ticks=2`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	assert.Equal(t, "Created 0, removed 0, changed 0 entities\n", resp.Output)
+
+	resp, err = client.Exec(`diff`)
+	assert.Nil(t, err)
+	assert.Equal(t, "no snapshot given; use diff <file> or diff ticks=<n>", resp.Error)
+
+	resp, err = client.Exec(`diff ticks=1 comps=velocity`)
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown component type in 'velocity'", resp.Error)
+	resp, err = client.Exec(`diff ticks=1 comps=position.X`)
+	assert.Nil(t, err)
+	assert.Equal(t, "expected a component, got field 'position.X'", resp.Error)
+}
+
+func TestDiffPaused(t *testing.T) {
+	world := ecs.NewWorld()
+	r := NewRepl(&world, Callbacks{Ticks: func() int { return 0 }})
+	r.SetTimeout(50 * time.Millisecond)
+	addr := "unix://" + filepath.Join(t.TempDir(), "repl.sock")
+	assert.Nil(t, r.StartServer(addr))
+	t.Cleanup(func() { assert.Nil(t, r.Close()) })
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				r.Poll()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	resp, err := client.Exec(`diff ticks=1`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusError, resp.Status)
+	assert.Equal(t, "repl: timeout: simulation did not tick within 50ms; it may be paused", resp.Error)
+}
+
+func TestCompareSnapshots(t *testing.T) {
+	world := ecs.NewWorld()
+	parent1 := world.NewEntity()
+	parent2 := world.NewEntity()
+	child := ecs.NewMap2[position, childOf](&world).NewEntity(&position{}, &childOf{}, ecs.Rel[childOf](parent1))
+	childID := ecs.ComponentID[childOf](&world)
+
+	old, err := takeWorldSnapshot(&world)
+	assert.Nil(t, err)
+	world.Unsafe().SetRelations(child, ecs.RelID(childID, parent2))
+	current, err := takeWorldSnapshot(&world)
+	assert.Nil(t, err)
+
+	result, err := compareSnapshots(componentTypes(&world), old, current, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []entityChange{{
+		Entity: child,
+		Fields: []fieldChange{{Field: "childOf (target)", Old: parent1, New: parent2}},
+	}}, result.Changed)
+
+	result, err = compareSnapshots(componentTypes(&world), old, current, map[string]bool{"repl.position": true})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Changed)
+}
+
+// chunkWriter sends written chunks to a channel.
+type chunkWriter chan string
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestTrace(t *testing.T) {
+	r, addr := newTestRepl(t)
+	ecs.ComponentID[agentInfo](r.world)
+	posMap := ecs.NewMap1[position](r.world)
+	posMap.NewEntity(&position{})
+	entity := posMap.NewEntity(&position{})
+
+	tracer, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+	client, err := protocol.NewClient(dialTest(t, addr), "")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunks := make(chunkWriter, 16)
+	done := make(chan protocol.Message)
+	go func() {
+		resp, err := tracer.ExecStream(ctx, "trace comps=repl.agentInfo", chunks)
+		assert.Nil(t, err)
+		close(chunks)
+		done <- resp
+	}()
+	output := <-chunks
+	assert.Equal(t, "Tracing events; cancel with Ctrl+C\n", output)
+
+	for _, cmd := range []string{
+		`spawn repl.agentInfo.Name=a`,
+		`spawn repl.position.X=1`,
+		fmt.Sprintf(`comp add %d repl.agentInfo.Name=b`, entity.ID()),
+		fmt.Sprintf(`comp remove %d comps=repl.agentInfo`, entity.ID()),
+		`despawn 4`,
+	} {
+		resp, err := client.Exec(cmd)
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	}
+	cancel()
+
+	resp := <-done
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	output = ""
+	for chunk := range chunks {
+		output += chunk
+	}
+	output = regexp.MustCompile(`\[\d+\]`).ReplaceAllString(output, "[t]")
+	assert.Equal(t, "[t] spawn   {4 0} [agentInfo]\n"+
+		"[t] add     {3 0} [agentInfo position]\n"+
+		"[t] remove  {3 0} [agentInfo position]\n"+
+		"[t] despawn {4 0} [agentInfo]\n"+
+		"Traced 4 events\n", output)
+
+	// Stops after the given number of events.
+	// Events are shown in all formats.
+	chunks = make(chunkWriter, 16)
+	go func() {
+		resp, err := tracer.ExecStream(context.Background(), "trace events=despawn n=1 format=json", chunks)
+		assert.Nil(t, err)
+		close(chunks)
+		done <- resp
+	}()
+	assert.Equal(t, "Tracing events; cancel with Ctrl+C\n", <-chunks)
+	resp, err = client.Exec(`despawn with=repl.position`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp = <-done
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	output = ""
+	for chunk := range chunks {
+		output += chunk
+	}
+	output = regexp.MustCompile(`\[\d+\]`).ReplaceAllString(output, "[t]")
+	assert.Equal(t, "[t] despawn {2 0} [position]\nTraced 1 events\n"+
+		"{\n  \"events\": 1,\n  \"dropped\": 0\n}\n", output)
+
+	// Values are not shown for spawn and add events.
+	chunks = make(chunkWriter, 16)
+	go func() {
+		resp, err := tracer.ExecStream(context.Background(), "trace events=spawn,despawn values n=2", chunks)
+		assert.Nil(t, err)
+		close(chunks)
+		done <- resp
+	}()
+	<-chunks
+	resp, err = client.Exec(`spawn repl.agentInfo.Name=c`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp, err = client.Exec(`despawn with=repl.agentInfo`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp = <-done
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	output = ""
+	for chunk := range chunks {
+		output += chunk
+	}
+	output = regexp.MustCompile(`\[\d+\]`).ReplaceAllString(output, "[t]")
+	assert.Equal(t, "[t] spawn   {3 1} [agentInfo]\n"+
+		"[t] despawn {3 1} [agentInfo={Name:c Inner:{A:0 B:0}}]\n"+
+		"Traced 2 events\n", output)
+
+	// Stops when the world is reset.
+	file := filepath.Join(t.TempDir(), "world.json")
+	resp, err = client.Exec(`save ` + file)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	chunks = make(chunkWriter, 16)
+	go func() {
+		resp, err := tracer.ExecStream(context.Background(), "trace", chunks)
+		assert.Nil(t, err)
+		close(chunks)
+		done <- resp
+	}()
+	assert.Equal(t, "Tracing events; cancel with Ctrl+C\n", <-chunks)
+	resp, err = client.Exec(`load ` + file + ` force=true`)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	resp = <-done
+	assert.Equal(t, protocol.StatusOk, resp.Status, resp.Error)
+	output = ""
+	for chunk := range chunks {
+		output += chunk
+	}
+	assert.Equal(t, "The world was reset by load; trace stopped\nTraced 0 events\n", output)
+
+	resp, err = client.Exec(`trace events=create`)
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown event 'create'; available: spawn, despawn, add, remove, set", resp.Error)
+}
+
+func TestTraceStop(t *testing.T) {
+	r, addr := newTestRepl(t)
+	observers := func() int {
+		count := 0
+		_, err := r.execStep(context.Background(), 0, func(world *ecs.World, _ io.Writer) (any, error) {
+			count = world.Stats().Observers
+			return nil, nil
+		}, false, io.Discard)
+		assert.Nil(t, err)
+		return count
+	}
+
+	conn := dialTest(t, addr)
+	tracer, err := protocol.NewClient(conn, "")
+	assert.Nil(t, err)
+	chunks := make(chunkWriter, 16)
+	go func() {
+		_, _ = tracer.ExecStream(context.Background(), "trace", chunks)
+	}()
+	<-chunks
+	assert.Positive(t, observers())
+	assert.Nil(t, conn.Close())
+	assert.Eventually(t, func() bool { return observers() == 0 }, time.Second, time.Millisecond)
+
+	conn = dialTest(t, addr)
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+	}
+	_, err = fmt.Fprintln(conn, "trace")
+	assert.Nil(t, err)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "Tracing events; press Enter to stop\n", line)
+	_, err = fmt.Fprintln(conn)
+	assert.Nil(t, err)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "Traced 0 events\n", line)
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, ">\n", line)
+	assert.Equal(t, 0, observers())
+
+	_, err = fmt.Fprintln(conn, "trace")
+	assert.Nil(t, err)
+	_, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Positive(t, observers())
+	assert.Nil(t, conn.Close())
+	assert.Eventually(t, func() bool { return observers() == 0 }, time.Second, time.Millisecond)
+}
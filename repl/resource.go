@@ -0,0 +1,131 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// resolveResource resolves a resource type name, either with package ("main.Grid")
+// or, if unambiguous, without ("Grid").
+// Returns the value of the resource as an addressable struct or other value.
+func resolveResource(world *ecs.World, name string) (reflect.Value, error) {
+	var candidates []ecs.ResID
+	available := []string{}
+	for _, id := range ecs.ResourceIDs(world) {
+		tp, _ := ecs.ResourceType(world, id)
+		available = append(available, tp.String())
+		if tp.String() == name || tp.Name() == name {
+			candidates = append(candidates, id)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return reflect.Value{}, fmt.Errorf("unknown resource type '%s'; available: %s", name, strings.Join(available, ", "))
+	}
+	if len(candidates) > 1 {
+		names := make([]string, len(candidates))
+		for i, id := range candidates {
+			tp, _ := ecs.ResourceType(world, id)
+			names[i] = tp.String()
+		}
+		return reflect.Value{}, fmt.Errorf("ambiguous resource type '%s'; candidates: %s", name, strings.Join(names, ", "))
+	}
+
+	res := world.Resources().Get(candidates[0])
+	if res == nil {
+		tp, _ := ecs.ResourceType(world, candidates[0])
+		return reflect.Value{}, fmt.Errorf("resource type %s is registered, but there is no such resource", tp)
+	}
+	return reflect.ValueOf(res).Elem(), nil
+}
+
+type resource struct {
+	Get resourceGet
+	Set resourceSet
+}
+
+func (c resource) Run(_ *ecs.World, out io.Writer) (any, error) {
+	fmt.Fprintln(out, "Shows or modifies resources. Run `help resource` for details.")
+	return nil, nil
+}
+
+func (c resource) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Shows or modifies resources.")
+}
+
+// resourceValue is the structured result of the resource commands.
+type resourceValue struct {
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type resourceGet struct {
+	Type string `positional:"" help:"Resource type, like Grid or main.Grid. The option name can be omitted."`
+}
+
+func (c resourceGet) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.Type == "" {
+		return nil, errors.New("no resource type given; use resource get <Type>")
+	}
+	value, err := resolveResource(world, c.Type)
+	if err != nil {
+		return nil, err
+	}
+	writePretty(out, 0, value.Type().String(), value)
+	return resourceValue{Type: value.Type().String(), Value: value.Addr().Interface()}, nil
+}
+
+func (c resourceGet) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Show a resource, like 'resource get Grid'.")
+}
+
+type resourceSet struct {
+	Type   string   `positional:"" help:"Resource type, like Grid or main.Grid. The option name can be omitted."`
+	Values []string `extra:"" help:"Field assignments like Width=10 or Size.X=5. The option name can be omitted."`
+}
+
+func (c resourceSet) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.Type == "" {
+		return nil, errors.New("no resource type given; use resource set <Type> <Field>=<value>")
+	}
+	if len(c.Values) == 0 {
+		return nil, errors.New("no values given; use resource set <Type> <Field>=<value>")
+	}
+	value, err := resolveResource(world, c.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse all values before modifying anything.
+	fields := make([]reflect.Value, len(c.Values))
+	newValues := make([]reflect.Value, len(c.Values))
+	for i, arg := range c.Values {
+		path, raw, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid assignment '%s'; expected <Field>=<value>", arg)
+		}
+		field, err := resolveNested(value.Type(), path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if newValues[i], err = parseValue(world, field.typ, path, raw); err != nil {
+			return nil, err
+		}
+		fields[i] = value.FieldByIndex(field.index)
+	}
+	for i := range fields {
+		fields[i].Set(newValues[i])
+	}
+
+	writePretty(out, 0, value.Type().String(), value)
+	return resourceValue{Type: value.Type().String(), Value: value.Addr().Interface()}, nil
+}
+
+func (c resourceSet) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Set fields of a resource, like 'resource set Grid Width=100 Height=50'.")
+}
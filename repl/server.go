@@ -0,0 +1,503 @@
+package repl
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlange-42/ark-repl/internal/protocol"
+)
+
+const (
+	greetingMessage = "Ark REPL connected. Type 'help' for commands.\n"
+	shutdownMessage = "REPL server shutting down"
+)
+
+// StartServer starts a server for the REPL.
+//
+// The addr argument should be either 'host:port', just ':port',
+// or 'unix:///path/to.sock' for a Unix domain socket.
+//
+// Unix domain sockets are created with permissions 0600, so only the owner can connect.
+// Use [os.Chmod] on the socket path to grant access to others.
+// A stale socket file left by a previous run is replaced.
+// The socket file is removed by [Repl.Shutdown].
+//
+// Multiple servers with different addresses can run at the same time,
+// as well as the terminal REPL started with [Repl.Start].
+//
+// Returns an error if listening fails.
+func (r *Repl) StartServer(addr string) error {
+	return r.startServer(addr, nil)
+}
+
+// StartServerTLS starts a server for the REPL that uses TLS,
+// with a certificate and matching key loaded from the given PEM files.
+//
+// See [Repl.StartServer] for supported addresses.
+func (r *Repl) StartServerTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load REPL server certificate: %w", err)
+	}
+	return r.startServer(addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// StartServerTLSConfig starts a server for the REPL that uses TLS with the given configuration.
+// The configuration must contain at least one certificate, or set GetCertificate.
+//
+// See [Repl.StartServer] for supported addresses.
+func (r *Repl) StartServerTLSConfig(addr string, config *tls.Config) error {
+	return r.startServer(addr, config)
+}
+
+func (r *Repl) startServer(addr string, config *tls.Config) error {
+	r.mu.Lock()
+	r.renew()
+	ctx := r.ctx
+	r.mu.Unlock()
+
+	ln, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to start REPL server: %w", err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+
+	r.mu.Lock()
+	if ctx.Err() != nil {
+		// Shut down in the meantime.
+		r.mu.Unlock()
+		_ = ln.Close()
+		return ErrClosed
+	}
+	r.listeners[ln] = struct{}{}
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	r.log().Info("REPL server listening", "address", addr, "tls", config != nil)
+	go r.serve(ctx, ln)
+	return nil
+}
+
+// listen creates a listener for a TCP or Unix domain socket address.
+func listen(addr string) (net.Listener, error) {
+	network, address := protocol.ParseAddress(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0o600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket file if no server is listening on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket '%s' is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// serve accepts connections until the listener is closed.
+func (r *Repl) serve(ctx context.Context, ln net.Listener) {
+	defer r.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.log().Error("REPL connection error", "error", err)
+			continue
+		}
+		if !r.addConn(ctx, conn) {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer r.removeConn(conn)
+			if err := r.handleConnection(ctx, conn); err != nil && ctx.Err() == nil {
+				r.log().Warn("REPL session failed", "remote", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+// addConn registers a connection, unless the REPL was shut down.
+func (r *Repl) addConn(ctx context.Context, conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	r.conns[conn] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+// removeConn unregisters a connection.
+func (r *Repl) removeConn(conn net.Conn) {
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+	r.wg.Done()
+}
+
+// session of a client connected to the server.
+type session struct {
+	repl   *Repl
+	ctx    context.Context
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	settings *settings
+
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelCauseFunc
+}
+
+func (s *session) write(str string) error {
+	if _, err := s.writer.WriteString(str); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+// handleConnection serves a client until it disconnects or the REPL is shut down.
+// Returns an error if communication with the client fails.
+func (r *Repl) handleConnection(ctx context.Context, conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	s := session{
+		repl:     r,
+		ctx:      ctx,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		settings: newSettings(),
+		cancels:  map[uint64]context.CancelCauseFunc{},
+	}
+
+	if err := s.write(greetingMessage + protocol.Prompt + "\n"); err != nil {
+		return err
+	}
+
+	line, err := protocol.ReadLine(s.reader, protocol.MaxRequestSize)
+	if err != nil && len(line) == 0 {
+		return ignoreEOF(err)
+	}
+	if hello, ok := protocol.ParseHello(line); ok {
+		if !r.authenticate(hello.Token) {
+			r.log().Warn("REPL authentication failed", "remote", conn.RemoteAddr())
+			msg := protocol.Message{
+				Type:    protocol.TypeHello,
+				Version: protocol.Version,
+				Error:   "authentication failed",
+			}
+			return protocol.WriteMessage(s.writer, &msg)
+		}
+		return s.handleFramed(&hello)
+	}
+
+	if r.token != "" {
+		if !r.authenticate(parseAuth(string(line))) {
+			r.log().Warn("REPL authentication failed", "remote", conn.RemoteAddr())
+			return s.write("authentication failed; send 'auth <token>' as first line\n")
+		}
+		line = nil
+	}
+	return s.handlePlain(string(line))
+}
+
+// ignoreEOF returns nil for [io.EOF], which is the regular end of a session.
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// authenticate checks a client's token against the REPL's token.
+func (r *Repl) authenticate(token string) bool {
+	if r.token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) == 1
+}
+
+// parseAuth extracts the token from a plain-text "auth <token>" line.
+func parseAuth(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != protocol.AuthCommand {
+		return ""
+	}
+	return fields[1]
+}
+
+// handleFramed serves a client that uses the framed protocol.
+func (s *session) handleFramed(hello *protocol.Message) error {
+	if hello.Version != protocol.Version {
+		msg := protocol.Message{
+			Type:    protocol.TypeHello,
+			Version: protocol.Version,
+			Error:   fmt.Sprintf("unsupported protocol version %d", hello.Version),
+		}
+		return protocol.WriteMessage(s.writer, &msg)
+	}
+	if err := protocol.WriteMessage(s.writer, &protocol.Message{Type: protocol.TypeHello, Version: protocol.Version}); err != nil {
+		return err
+	}
+
+	requests := make(chan request)
+	quit := make(chan struct{})
+	defer close(quit)
+	var readErr error
+	go func() {
+		readErr = s.readRequests(requests, quit)
+		close(requests)
+	}()
+
+	for req := range requests {
+		resp := protocol.Message{
+			Type:   protocol.TypeResult,
+			ID:     req.ID,
+			Status: protocol.StatusOk,
+		}
+		if req.Type != protocol.TypeExec {
+			resp.Status = protocol.StatusError
+			resp.Error = fmt.Sprintf("unexpected message of type '%s'", req.Type)
+			if err := protocol.WriteMessage(s.writer, &resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stream := newStream(s.ctx, func(chunk []byte) error {
+			return protocol.WriteMessage(s.writer, &protocol.Message{Type: protocol.TypeOutput, ID: req.ID, Output: string(chunk)})
+		})
+		out := s.repl.newOutput(stream.Send)
+		timeout := time.Duration(req.Timeout) * time.Millisecond
+		result, cont, err := s.repl.handleCommand(req.ctx, s.settings, req.Command, timeout, req.WithData, out)
+		s.finishRequest(req.ID)
+		if err := stream.Close(); err != nil {
+			return err
+		}
+		resp.Output = out.Rest()
+		resp.Data = result
+		if err != nil {
+			resp.Status = protocol.StatusError
+			if errors.Is(err, ErrBusy) {
+				resp.Status = protocol.StatusBusy
+			}
+			resp.Error = err.Error()
+		}
+		if !cont {
+			resp.Status = protocol.StatusExit
+		}
+		if err := protocol.WriteMessage(s.writer, &resp); err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+
+	if s.ctx.Err() != nil {
+		return protocol.WriteMessage(s.writer, &protocol.Message{Type: protocol.TypeClose, Output: shutdownMessage})
+	}
+	return ignoreEOF(readErr)
+}
+
+// request received by a framed session.
+type request struct {
+	protocol.Message
+	ctx context.Context
+}
+
+// readRequests reads messages from the client until reading fails or quit is closed.
+//
+// Cancel messages are handled immediately, so that queued commands can be canceled.
+// All other messages are forwarded to the requests channel.
+// If reading fails, like when the client disconnects, all unfinished requests are canceled.
+func (s *session) readRequests(requests chan<- request, quit <-chan struct{}) error {
+	for {
+		msg, err := protocol.ReadMessage(s.reader, protocol.MaxRequestSize)
+		if err != nil {
+			s.cancelAll()
+			return err
+		}
+		if msg.Type == protocol.TypeCancel {
+			s.cancelRequest(msg.ID)
+			continue
+		}
+
+		// Register before forwarding, so that a subsequent cancel message finds the request.
+		ctx, cancel := context.WithCancelCause(s.ctx)
+		s.mu.Lock()
+		s.cancels[msg.ID] = cancel
+		s.mu.Unlock()
+
+		select {
+		case requests <- request{Message: msg, ctx: ctx}:
+		case <-quit:
+			s.finishRequest(msg.ID)
+			return nil
+		}
+	}
+}
+
+// cancelRequest cancels a request if it has not finished yet.
+func (s *session) cancelRequest(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.cancels[id]; ok {
+		cancel(ErrCanceled)
+	}
+}
+
+// cancelAll cancels all requests that have not finished yet.
+func (s *session) cancelAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancel := range s.cancels {
+		cancel(ErrCanceled)
+	}
+}
+
+// finishRequest releases the resources of a request.
+func (s *session) finishRequest(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.cancels[id]; ok {
+		cancel(nil)
+		delete(s.cancels, id)
+	}
+}
+
+// handlePlain serves a plain-text client, like nc.
+//
+// Lines are read in the background, so that a running command is canceled when the client disconnects.
+func (s *session) handlePlain(firstLine string) error {
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+
+	lines := make(chan string)
+	quit := make(chan struct{})
+	defer close(quit)
+	var readErr error
+	go func() {
+		readErr = s.readLines(lines, quit)
+		cancel(ErrCanceled)
+		close(lines)
+	}()
+
+	// A line stops a streaming command, as well as the end of the input.
+	s.settings.interrupt = func(done <-chan struct{}) bool {
+		select {
+		case <-lines:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	s.settings.stopHint = "press Enter to stop"
+
+	line := firstLine
+	for {
+		cont, err := s.handlePlainLine(ctx, line)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			break
+		}
+		if err := s.write(protocol.Prompt + "\n"); err != nil {
+			return err
+		}
+
+		var ok bool
+		if line, ok = <-lines; !ok {
+			if s.ctx.Err() == nil && readErr != nil {
+				return readErr
+			}
+			break
+		}
+	}
+
+	if s.ctx.Err() != nil {
+		return s.write(shutdownMessage + "\n")
+	}
+	return nil
+}
+
+// readLines reads lines from a plain-text client until reading fails or quit is closed.
+func (s *session) readLines(lines chan<- string, quit <-chan struct{}) error {
+	scanner := bufio.NewScanner(s.reader)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-quit:
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// handlePlainLine runs a single command for a plain-text client.
+// Returns false if the session should end, and an error if writing to the client failed.
+func (s *session) handlePlainLine(ctx context.Context, line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true, nil
+	}
+
+	stream := newStream(s.ctx, func(chunk []byte) error {
+		return s.write(string(chunk))
+	})
+	out := s.repl.newOutput(stream.Send)
+	_, cont, err := s.repl.handleCommand(ctx, s.settings, line, 0, false, out)
+	_ = out.Flush()
+	if err := stream.Close(); err != nil {
+		return false, err
+	}
+	if err != nil {
+		if err := s.write(err.Error() + "\n"); err != nil {
+			return false, err
+		}
+	}
+	return cont, nil
+}
@@ -0,0 +1,360 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/mlange-42/ark/ecs"
+)
+
+// worldSnapshot is a serializable snapshot of a world,
+// with entities, components, relations and resources.
+// Component and resource types are identified by their full type name, like "main.Position".
+type worldSnapshot struct {
+	Pool      ecs.EntityDump             `json:"pool"`
+	Entities  []entitySnapshot           `json:"entities"`
+	Resources map[string]json.RawMessage `json:"resources"`
+}
+
+// entitySnapshot holds the components and relation targets of an entity.
+type entitySnapshot struct {
+	Entity     ecs.Entity                 `json:"entity"`
+	Components map[string]json.RawMessage `json:"components"`
+	Relations  map[string]ecs.Entity      `json:"relations,omitempty"`
+}
+
+// snapshotInfo is the structured result of the save and load commands.
+type snapshotInfo struct {
+	File      string `json:"file"`
+	Entities  int    `json:"entities"`
+	Resources int    `json:"resources"`
+}
+
+// takeWorldSnapshot serializes the current state of the world.
+// Only exported fields of components and resources are included.
+func takeWorldSnapshot(world *ecs.World) (*worldSnapshot, error) {
+	snap := worldSnapshot{
+		Pool:      world.Unsafe().DumpEntities(),
+		Entities:  []entitySnapshot{},
+		Resources: map[string]json.RawMessage{},
+	}
+
+	allIDs := ecs.ComponentIDs(world)
+	infos := make([]ecs.CompInfo, len(allIDs))
+	for i, id := range allIDs {
+		infos[i], _ = ecs.ComponentInfo(world, id)
+	}
+
+	query := ecs.NewUnsafeFilter(world).Query()
+	closed := false
+	defer func() {
+		if !closed {
+			query.Close()
+		}
+	}()
+	for query.Next() {
+		entity := entitySnapshot{Entity: query.Entity(), Components: map[string]json.RawMessage{}}
+		ids := query.IDs()
+		for i := range ids.Len() {
+			id := ids.Get(i)
+			info := &infos[id.Index()]
+			data, err := marshalJSON(reflect.NewAt(info.Type, query.Get(id)).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("can't serialize component %s of entity %v: %w", info.Type, entity.Entity, err)
+			}
+			entity.Components[info.Type.String()] = data
+			if info.IsRelation {
+				if entity.Relations == nil {
+					entity.Relations = map[string]ecs.Entity{}
+				}
+				entity.Relations[info.Type.String()] = query.GetRelation(id)
+			}
+		}
+		snap.Entities = append(snap.Entities, entity)
+	}
+	closed = true
+
+	for _, id := range ecs.ResourceIDs(world) {
+		res := world.Resources().Get(id)
+		if res == nil {
+			continue
+		}
+		tp, _ := ecs.ResourceType(world, id)
+		data, err := marshalJSON(res)
+		if err != nil {
+			return nil, fmt.Errorf("can't serialize resource %s: %w", tp, err)
+		}
+		snap.Resources[tp.String()] = data
+	}
+	return &snap, nil
+}
+
+// readSnapshot reads a snapshot from a JSON file.
+func readSnapshot(file string) (*worldSnapshot, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	snap := worldSnapshot{}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot file %s: %w", file, err)
+	}
+	return &snap, nil
+}
+
+// loadedEntity is an entity of a snapshot, decoded and ready for adding to the world.
+type loadedEntity struct {
+	entity    ecs.Entity
+	ids       []ecs.ID
+	values    []reflect.Value
+	relations []ecs.Relation
+}
+
+// restore replaces the world's state by the snapshot.
+//
+// The snapshot is decoded and validated completely before modifying the world.
+// The world is reset, which also un-registers all observers and filter caches.
+// Resources are restored in place, so pointers to them stay valid.
+// Resources that are not in the snapshot are kept.
+func (s *worldSnapshot) restore(world *ecs.World) error {
+	compTypes := componentTypes(world)
+
+	alive, err := s.validatePool()
+	if err != nil {
+		return err
+	}
+	isAlive := func(e ecs.Entity) bool {
+		return alive[e.ID()] && s.Pool.Entities[e.ID()].Gen() == e.Gen()
+	}
+
+	entities := make([]loadedEntity, 0, len(s.Entities))
+	seen := make(map[uint32]bool, len(s.Entities))
+	for _, e := range s.Entities {
+		if !isAlive(e.Entity) {
+			return fmt.Errorf("invalid snapshot: entity %v is not alive", e.Entity)
+		}
+		if seen[e.Entity.ID()] {
+			return fmt.Errorf("invalid snapshot: duplicate entity %v", e.Entity)
+		}
+		seen[e.Entity.ID()] = true
+		loaded := loadedEntity{entity: s.Pool.Entities[e.Entity.ID()]}
+		// Sorted, so that validation errors are deterministic.
+		for _, name := range slices.Sorted(maps.Keys(e.Components)) {
+			info, value, err := decodeComponent(compTypes, name, e.Entity, e.Components[name])
+			if err != nil {
+				return err
+			}
+			loaded.ids = append(loaded.ids, info.ID)
+			loaded.values = append(loaded.values, value)
+		}
+		for _, name := range slices.Sorted(maps.Keys(e.Relations)) {
+			target := e.Relations[name]
+			info, ok := compTypes[name]
+			if !ok || !info.IsRelation {
+				return fmt.Errorf("invalid snapshot: %s of entity %v is not a relation component", name, e.Entity)
+			}
+			if _, ok := e.Components[name]; !ok {
+				return fmt.Errorf("invalid snapshot: relation %s of entity %v has no component", name, e.Entity)
+			}
+			if !target.IsZero() && !isAlive(target) {
+				return fmt.Errorf("invalid snapshot: relation target %v of entity %v is not alive", target, e.Entity)
+			}
+			loaded.relations = append(loaded.relations, ecs.RelID(info.ID, target))
+		}
+		entities = append(entities, loaded)
+	}
+
+	resTypes := map[string]ecs.ResID{}
+	for _, id := range ecs.ResourceIDs(world) {
+		tp, _ := ecs.ResourceType(world, id)
+		resTypes[tp.String()] = id
+	}
+	resValues := map[ecs.ResID]reflect.Value{}
+	for _, name := range slices.Sorted(maps.Keys(s.Resources)) {
+		data := s.Resources[name]
+		id, ok := resTypes[name]
+		if !ok {
+			return fmt.Errorf("unknown resource type %s; it must be registered in the world", name)
+		}
+		tp, _ := ecs.ResourceType(world, id)
+		value := reflect.New(tp)
+		if err := unmarshalJSON(data, value.Interface()); err != nil {
+			return fmt.Errorf("invalid value for resource %s: %w", name, err)
+		}
+		resValues[id] = value.Elem()
+	}
+
+	// Keep all resources, as resetting the world removes them.
+	resources := map[ecs.ResID]any{}
+	for _, id := range ecs.ResourceIDs(world) {
+		if res := world.Resources().Get(id); res != nil {
+			resources[id] = res
+		}
+	}
+
+	world.Reset()
+	for id, res := range resources {
+		world.Resources().Add(id, res)
+	}
+	for id, value := range resValues {
+		res, ok := resources[id]
+		if !ok {
+			res = reflect.New(value.Type()).Interface()
+			world.Resources().Add(id, res)
+		}
+		reflect.ValueOf(res).Elem().Set(value)
+	}
+
+	u := world.Unsafe()
+	u.LoadEntities(&s.Pool)
+	for i := range entities {
+		e := &entities[i]
+		if len(e.ids) == 0 {
+			continue
+		}
+		u.AddRel(e.entity, e.ids, e.relations...)
+		for j, id := range e.ids {
+			reflect.NewAt(e.values[j].Type(), u.Get(e.entity, id)).Elem().Set(e.values[j])
+		}
+	}
+	return nil
+}
+
+// validatePool checks that the snapshot's entity pool is consistent,
+// as the world panics on an invalid pool after loading it.
+// Returns the IDs of the alive entities.
+//
+// Reserved and alive entries must hold their own ID.
+// Dead entries form the free list, starting at Next and linked by their IDs.
+func (s *worldSnapshot) validatePool() (map[uint32]bool, error) {
+	pool := &s.Pool
+	if len(pool.Entities) < reservedEntities {
+		return nil, fmt.Errorf("invalid snapshot: entity pool has %d entries, expected at least %d", len(pool.Entities), reservedEntities)
+	}
+	for i := range uint32(reservedEntities) {
+		if pool.Entities[i].ID() != i {
+			return nil, fmt.Errorf("invalid snapshot: reserved entity %d has ID %d", i, pool.Entities[i].ID())
+		}
+	}
+
+	alive := make(map[uint32]bool, len(pool.Alive))
+	for _, id := range pool.Alive {
+		if id < reservedEntities || int(id) >= len(pool.Entities) {
+			return nil, fmt.Errorf("invalid snapshot: entity %d is out of range", id)
+		}
+		if alive[id] {
+			return nil, fmt.Errorf("invalid snapshot: entity %d is alive twice", id)
+		}
+		if pool.Entities[id].ID() != id {
+			return nil, fmt.Errorf("invalid snapshot: alive entity %d has ID %d", id, pool.Entities[id].ID())
+		}
+		alive[id] = true
+	}
+
+	dead := len(pool.Entities) - reservedEntities - len(alive)
+	if int(pool.Available) != dead {
+		return nil, fmt.Errorf("invalid snapshot: %d entities available, but %d are dead", pool.Available, dead)
+	}
+	free := make(map[uint32]bool, dead)
+	next := pool.Next
+	for range pool.Available {
+		if next < reservedEntities || int(next) >= len(pool.Entities) || alive[next] || free[next] {
+			return nil, fmt.Errorf("invalid snapshot: broken free list of dead entities at %d", next)
+		}
+		free[next] = true
+		next = pool.Entities[next].ID()
+	}
+	return alive, nil
+}
+
+// componentTypes returns the world's component types by their full type name.
+func componentTypes(world *ecs.World) map[string]ecs.CompInfo {
+	types := map[string]ecs.CompInfo{}
+	for _, id := range ecs.ComponentIDs(world) {
+		info, _ := ecs.ComponentInfo(world, id)
+		types[info.Type.String()] = info
+	}
+	return types
+}
+
+// decodeComponent decodes a serialized component of an entity.
+// The component type must be registered in the world.
+func decodeComponent(types map[string]ecs.CompInfo, name string, entity ecs.Entity, data json.RawMessage) (ecs.CompInfo, reflect.Value, error) {
+	info, ok := types[name]
+	if !ok {
+		return info, reflect.Value{}, fmt.Errorf("unknown component type %s; it must be registered in the world", name)
+	}
+	value := reflect.New(info.Type)
+	if err := unmarshalJSON(data, value.Interface()); err != nil {
+		return info, reflect.Value{}, fmt.Errorf("invalid value for component %s of entity %v: %w", name, entity, err)
+	}
+	return info, value.Elem(), nil
+}
+
+type save struct {
+	File string `positional:"" help:"File to save to, on the host of the application. The option name can be omitted."`
+}
+
+func (c save) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.File == "" {
+		return nil, errors.New("no file given; use save <file>")
+	}
+	snap, err := takeWorldSnapshot(world)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(c.File, data, 0o644); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Saved %d entities and %d resources to %s\n", len(snap.Entities), len(snap.Resources), c.File)
+	return snapshotInfo{File: c.File, Entities: len(snap.Entities), Resources: len(snap.Resources)}, nil
+}
+
+func (c save) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Save a snapshot of the world to a JSON file, with entities, components, relations and resources.")
+	fmt.Fprintln(out, "Only exported fields of components and resources are saved.")
+}
+
+type load struct {
+	repl  *Repl
+	File  string `positional:"" help:"File to load from, on the host of the application. The option name can be omitted."`
+	Force bool   `help:"Load even if the world has observers or cached filters, which are removed by loading."`
+}
+
+func (c load) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.File == "" {
+		return nil, errors.New("no file given; use load <file>")
+	}
+	snap, err := readSnapshot(c.File)
+	if err != nil {
+		return nil, err
+	}
+	if stats := world.Stats(); !c.Force && (stats.Observers > 0 || stats.CachedFilters > 0) {
+		return nil, fmt.Errorf("the world has %d observers and %d cached filters, which would be removed by loading; "+
+			"the simulation may not work correctly afterwards. Use force=true to load anyway", stats.Observers, stats.CachedFilters)
+	}
+	if err := snap.restore(world); err != nil {
+		return nil, err
+	}
+	c.repl.notifyReset()
+	fmt.Fprintf(out, "Loaded %d entities and %d resources from %s\n", len(snap.Entities), len(snap.Resources), c.File)
+	return snapshotInfo{File: c.File, Entities: len(snap.Entities), Resources: len(snap.Resources)}, nil
+}
+
+func (c load) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Replace the world by a snapshot saved with 'save'.")
+	fmt.Fprintln(out, "All component and resource types must be registered in the world.")
+	fmt.Fprintln(out, "Resets the world before loading, which also un-registers observers and filter caches.")
+	fmt.Fprintln(out, "Refuses to load if there are any, unless forced. Running traces are stopped.")
+}
@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// stdin is the shared reader for the terminal REPL.
+var stdin = newLineReader(os.Stdin)
+
+// lineReader reads lines on request, so that a REPL loop can stop while waiting for input.
+//
+// Lines are only read when requested, so that no input is consumed
+// while others use the terminal (like the monitor TUI).
+// A pending request survives the end of a REPL loop, and is delivered to the next one.
+type lineReader struct {
+	once     sync.Once
+	input    io.Reader
+	requests chan struct{}
+	lines    chan string
+	pending  atomic.Bool
+}
+
+func newLineReader(input io.Reader) *lineReader {
+	return &lineReader{
+		input:    input,
+		requests: make(chan struct{}, 1),
+		lines:    make(chan string),
+	}
+}
+
+// readLine reads the next line.
+// Returns false at the end of the input, or when done is closed.
+func (l *lineReader) readLine(done <-chan struct{}) (string, bool) {
+	l.once.Do(func() { go l.run() })
+
+	if !l.pending.Swap(true) {
+		l.requests <- struct{}{}
+	}
+	select {
+	case line, ok := <-l.lines:
+		if ok {
+			l.pending.Store(false)
+		}
+		return line, ok
+	case <-done:
+		return "", false
+	}
+}
+
+func (l *lineReader) run() {
+	scanner := bufio.NewScanner(l.input)
+	for range l.requests {
+		if !scanner.Scan() {
+			close(l.lines)
+			return
+		}
+		l.lines <- scanner.Text()
+	}
+}
@@ -0,0 +1,273 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+// maxTraceBuffer is the maximum size of buffered trace output, in bytes.
+// Events are dropped if the client can't keep up.
+const maxTraceBuffer = 1 << 20
+
+// Trace events, named after the commands that cause them.
+const (
+	traceSpawn   = "spawn"
+	traceDespawn = "despawn"
+	traceAdd     = "add"
+	traceRemove  = "remove"
+	traceSet     = "set"
+)
+
+var traceEvents = []string{traceSpawn, traceDespawn, traceAdd, traceRemove, traceSet}
+
+type trace struct {
+	repl   *Repl
+	Events []string `help:"Events to trace, from spawn, despawn, add, remove and set. All if not given."`
+	Comps  []string `help:"Only trace events of entities with any of these components."`
+	Entity string   `help:"Only trace events of this entity, as <id>[.<gen>]."`
+	Values bool     `help:"Show component values of despawn, remove and set events."`
+	N      int      `help:"Stop after this number of events. Unlimited if 0."`
+}
+
+// traceResult is the structured result of the trace command.
+type traceResult struct {
+	Events  int `json:"events"`
+	Dropped int `json:"dropped"`
+}
+
+func (c trace) stream(ctx context.Context, timeout time.Duration, stopHint string, encode bool, out io.Writer) (*snapshot, error) {
+	events := traceEvents
+	if len(c.Events) > 0 {
+		for _, evt := range c.Events {
+			if !slices.Contains(traceEvents, evt) {
+				return nil, fmt.Errorf("unknown event '%s'; available: %s", evt, strings.Join(traceEvents, ", "))
+			}
+		}
+		events = c.Events
+	}
+
+	buffer := traceBuffer{limit: c.N, notify: make(chan struct{}, 1)}
+	var observers []*ecs.Observer
+	var reset <-chan struct{}
+	_, err := c.repl.execStep(ctx, timeout, func(world *ecs.World, _ io.Writer) (any, error) {
+		var err error
+		observers, err = c.register(world, events, &buffer)
+		reset = c.repl.nextReset()
+		return nil, err
+	}, false, out)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Tracing events; %s\n", stopHint)
+	if err := flush(out); err != nil {
+		return nil, c.unregister(ctx, timeout, observers, err)
+	}
+
+	wasReset := false
+loop:
+	for {
+		select {
+		case <-buffer.notify:
+			if err := buffer.writeTo(out); err != nil {
+				return nil, c.unregister(ctx, timeout, observers, err)
+			}
+			if c.N > 0 && buffer.count() >= c.N {
+				break loop
+			}
+		case <-reset:
+			wasReset = true
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	if wasReset {
+		// Observers were already removed by resetting the world.
+		_ = buffer.writeTo(out)
+		fmt.Fprintln(out, "The world was reset by load; trace stopped")
+	} else {
+		if err := c.unregister(ctx, timeout, observers, nil); err != nil {
+			return nil, err
+		}
+		_ = buffer.writeTo(out)
+	}
+	result := buffer.result()
+	fmt.Fprintf(out, "Traced %d events\n", result.Events)
+	if !encode {
+		return nil, nil
+	}
+	return takeSnapshot(result)
+}
+
+// liveOutput implements [liveStreamer], so that events are shown in all output formats.
+func (c trace) liveOutput() {}
+
+func (c trace) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Stream entity and component events until stopped, like 'trace comps=Position'.")
+	fmt.Fprintln(out, "Stop with Ctrl+C in the ark client, or by pressing Enter in the terminal and in plain-text sessions.")
+	fmt.Fprintln(out, "Events are spawn and despawn of entities, and add, remove and set of components.")
+	fmt.Fprintln(out, "Events show all components of the entity, after adding and before removing components.")
+	fmt.Fprintln(out, "Set events are only emitted by ark's Set methods, not by modifying components through pointers.")
+	fmt.Fprintln(out, "The REPL's own 'set' and 'resource set' commands don't emit set events.")
+	fmt.Fprintln(out, "Values are not shown for spawn and add events, as components created by the REPL")
+	fmt.Fprintln(out, "are only initialized after the event.")
+	fmt.Fprintln(out, "Events are always shown as text; other output formats only apply to the final summary.")
+}
+
+// register creates and registers the observers for the trace.
+//
+// Observers are not restricted to components, as ark requires the static types for that.
+// Instead, events are filtered by the components of the entity.
+func (c trace) register(world *ecs.World, events []string, buffer *traceBuffer) ([]*ecs.Observer, error) {
+	ids, err := getComponentIDs(world, c.Comps)
+	if err != nil {
+		return nil, err
+	}
+	var entity ecs.Entity
+	if c.Entity != "" {
+		if entity, err = resolveEntity(world, c.Entity); err != nil {
+			return nil, err
+		}
+	}
+
+	u := world.Unsafe()
+	matches := func(e ecs.Entity) bool {
+		if c.Entity != "" && e != entity {
+			return false
+		}
+		return len(ids) == 0 || slices.ContainsFunc(ids, func(id ecs.ID) bool { return u.Has(e, id) })
+	}
+	components := func(e ecs.Entity, values bool) string {
+		entityIDs := u.IDs(e)
+		comps := make([]string, entityIDs.Len())
+		for i := range entityIDs.Len() {
+			id := entityIDs.Get(i)
+			info, _ := ecs.ComponentInfo(world, id)
+			comps[i] = info.Type.Name()
+			if values {
+				comps[i] += fmt.Sprintf("=%+v", reflect.NewAt(info.Type, u.Get(e, id)).Elem())
+			}
+		}
+		return "[" + strings.Join(comps, " ") + "]"
+	}
+
+	eventTypes := map[string]ecs.EventType{
+		traceSpawn:   ecs.OnCreateEntity,
+		traceDespawn: ecs.OnRemoveEntity,
+		traceAdd:     ecs.OnAddComponents,
+		traceRemove:  ecs.OnRemoveComponents,
+		traceSet:     ecs.OnSetComponents,
+	}
+	observers := make([]*ecs.Observer, len(events))
+	for i, evt := range events {
+		// Components created by the REPL are not yet initialized when the event is emitted.
+		values := c.Values && evt != traceSpawn && evt != traceAdd
+		observers[i] = ecs.Observe(eventTypes[evt]).Do(func(e ecs.Entity) {
+			if matches(e) {
+				buffer.add(c.repl.tick(), evt, e, components(e, values))
+			}
+		})
+	}
+	for _, obs := range observers {
+		obs.Register(world)
+	}
+	return observers, nil
+}
+
+// unregister removes the observers of the trace.
+// Is executed even if the trace's context is done.
+// Returns the given error, or the error of the removal.
+func (c trace) unregister(ctx context.Context, timeout time.Duration, observers []*ecs.Observer, err error) error {
+	_, unregErr := c.repl.execStep(context.WithoutCancel(ctx), timeout, func(world *ecs.World, _ io.Writer) (any, error) {
+		for _, obs := range observers {
+			obs.Unregister(world)
+		}
+		return nil, nil
+	}, false, io.Discard)
+	if err != nil {
+		return err
+	}
+	return unregErr
+}
+
+// flush forwards buffered output to the client, if the writer supports it.
+func flush(out io.Writer) error {
+	if f, ok := out.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// traceBuffer collects events from observers, until they are written by the session.
+//
+// Observers are called by the simulation, so they must not block on slow clients.
+// Events are dropped if the buffer is full.
+type traceBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	limit   int
+	events  int
+	dropped int
+	skipped int
+	notify  chan struct{}
+}
+
+// add formats and adds an event.
+func (b *traceBuffer) add(tick int, event string, entity ecs.Entity, detail string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.events >= b.limit {
+		return
+	}
+	b.events++
+	line := fmt.Sprintf("[%d] %-7s %v %s\n", tick, event, entity, detail)
+	if len(b.buf)+len(line) > maxTraceBuffer {
+		b.dropped++
+		b.skipped++
+	} else {
+		b.buf = append(b.buf, line...)
+	}
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// writeTo writes and flushes the buffered events.
+func (b *traceBuffer) writeTo(out io.Writer) error {
+	b.mu.Lock()
+	data, skipped := b.buf, b.skipped
+	b.buf, b.skipped = nil, 0
+	b.mu.Unlock()
+
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(out, "... %d events dropped; the client can't keep up\n", skipped)
+	}
+	return flush(out)
+}
+
+// count returns the number of events so far.
+func (b *traceBuffer) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.events
+}
+
+// result returns the structured result of the trace.
+func (b *traceBuffer) result() traceResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return traceResult{Events: b.events, Dropped: b.dropped}
+}
@@ -0,0 +1,205 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unsafe"
+
+	"github.com/mlange-42/ark/ecs"
+)
+
+type tree struct {
+	Comp   string   `positional:"" help:"Relation component, like ChildOf or main.ChildOf. The option name can be omitted."`
+	Root   string   `help:"Only show the subtree of this entity, as <id>[.<gen>]."`
+	Depth  int      `help:"Maximum depth to show. Unlimited if 0."`
+	Fields []string `help:"Components or fields to show for each entity, like Name.Value."`
+}
+
+// treeNode is an entity in the structured result of the tree command.
+type treeNode struct {
+	Entity ecs.Entity     `json:"entity"`
+	Fields map[string]any `json:"fields,omitempty"`
+	// Child nodes of type treeNode.
+	// Not typed, as go-json fails to encode recursive types with maps of interfaces.
+	Children []any `json:"children,omitempty"`
+}
+
+func (c tree) Run(world *ecs.World, out io.Writer) (any, error) {
+	if c.Comp == "" {
+		return nil, errors.New("no relation component given; use tree <Component>")
+	}
+	relID, err := resolveRelation(world, c.Comp)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := resolveFieldList(world, c.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Children by parent, parents by child, and parents in the order they were first seen.
+	children := map[ecs.Entity][]ecs.Entity{}
+	parentOf := map[ecs.Entity]ecs.Entity{}
+	parents := []ecs.Entity{}
+	query := ecs.NewUnsafeFilter(world, relID).Query()
+	for query.Next() {
+		entity := query.Entity()
+		parent := query.GetRelation(relID)
+		if parent.IsZero() {
+			if _, ok := children[entity]; !ok {
+				children[entity] = []ecs.Entity{}
+				parents = append(parents, entity)
+			}
+			continue
+		}
+		parentOf[entity] = parent
+		if _, ok := children[parent]; !ok {
+			parents = append(parents, parent)
+		}
+		children[parent] = append(children[parent], entity)
+	}
+
+	roots := []ecs.Entity{}
+	if c.Root != "" {
+		root, err := resolveEntity(world, c.Root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	} else {
+		for _, p := range parents {
+			if _, ok := parentOf[p]; !ok {
+				roots = append(roots, p)
+			}
+		}
+		roots = append(roots, cycleRoots(parents, parentOf, children, roots)...)
+	}
+
+	w := treeWriter{
+		world:    world,
+		out:      out,
+		children: children,
+		fields:   fields,
+		depth:    c.Depth,
+		visited:  map[ecs.Entity]bool{},
+	}
+	result := make([]treeNode, 0, len(roots))
+	for _, root := range roots {
+		result = append(result, w.write(root, "", "", 1))
+		if w.err != nil {
+			return nil, w.err
+		}
+	}
+	if len(result) == 0 {
+		fmt.Fprintln(out, "No entities with relation", c.Comp)
+	}
+	return result, nil
+}
+
+func (c tree) Help(out *strings.Builder) {
+	fmt.Fprintln(out, "Show the hierarchy of a relation component as a tree, like 'tree ChildOf'.")
+	fmt.Fprintln(out, "Roots are relation targets that don't have the relation themselves.")
+	fmt.Fprintln(out, "Cycles without such a root are shown starting at one of their entities.")
+}
+
+// cycleRoots returns an entity of each cycle that can't be reached from the roots,
+// so that these cycles are shown as well.
+func cycleRoots(parents []ecs.Entity, parentOf map[ecs.Entity]ecs.Entity, children map[ecs.Entity][]ecs.Entity, roots []ecs.Entity) []ecs.Entity {
+	reached := map[ecs.Entity]bool{}
+	reach := func(entity ecs.Entity) {
+		stack := []ecs.Entity{entity}
+		for len(stack) > 0 {
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if reached[e] {
+				continue
+			}
+			reached[e] = true
+			stack = append(stack, children[e]...)
+		}
+	}
+	for _, root := range roots {
+		reach(root)
+	}
+
+	cycles := []ecs.Entity{}
+	for _, p := range parents {
+		if reached[p] {
+			continue
+		}
+		// Unreachable entities are in a cycle or below one.
+		// Going up, the first entity that is seen twice is in the cycle.
+		seen := map[ecs.Entity]bool{}
+		e := p
+		for !seen[e] {
+			seen[e] = true
+			e = parentOf[e]
+		}
+		cycles = append(cycles, e)
+		reach(e)
+	}
+	return cycles
+}
+
+// treeWriter writes entity hierarchies for the tree command.
+type treeWriter struct {
+	world    *ecs.World
+	out      io.Writer
+	children map[ecs.Entity][]ecs.Entity
+	fields   []fieldPath
+	depth    int
+	visited  map[ecs.Entity]bool
+	// First write error, which stops writing.
+	err error
+}
+
+// write writes an entity and its descendants.
+// The prefix is used for the entity itself, the indent for its children.
+func (w *treeWriter) write(entity ecs.Entity, prefix, indent string, level int) treeNode {
+	node := treeNode{Entity: entity}
+	if w.err != nil {
+		return node
+	}
+	label := fmt.Sprint(entity)
+
+	if w.world.Alive(entity) {
+		u := w.world.Unsafe()
+		for i := range w.fields {
+			f := &w.fields[i]
+			if !u.Has(entity, f.comp) {
+				continue
+			}
+			val := f.value(func(id ecs.ID) unsafe.Pointer { return u.Get(entity, id) }).Interface()
+			if node.Fields == nil {
+				node.Fields = map[string]any{}
+			}
+			node.Fields[f.name] = val
+			label += fmt.Sprintf(" %s=%+v", f.name, val)
+		}
+	}
+
+	children := w.children[entity]
+	switch {
+	case w.visited[entity]:
+		_, w.err = fmt.Fprintf(w.out, "%s%s (cycle)\n", prefix, label)
+		return node
+	case w.depth > 0 && level >= w.depth && len(children) > 0:
+		_, w.err = fmt.Fprintf(w.out, "%s%s (+%d children)\n", prefix, label, len(children))
+		return node
+	}
+	if _, w.err = fmt.Fprintf(w.out, "%s%s\n", prefix, label); w.err != nil {
+		return node
+	}
+	w.visited[entity] = true
+
+	for i, child := range children {
+		if i < len(children)-1 {
+			node.Children = append(node.Children, w.write(child, indent+"├─ ", indent+"│  ", level+1))
+		} else {
+			node.Children = append(node.Children, w.write(child, indent+"└─ ", indent+"   ", level+1))
+		}
+	}
+	return node
+}
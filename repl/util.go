@@ -3,31 +3,150 @@ package repl
 import (
 	"fmt"
 	"math"
+	"slices"
+	"strings"
 
 	"github.com/mlange-42/ark/ecs"
 )
 
+// getComponentIDs resolves component names, with or without package like for [resolveField].
 func getComponentIDs(world *ecs.World, compNames []string) ([]ecs.ID, error) {
-	ids := []ecs.ID{}
+	ids := make([]ecs.ID, 0, len(compNames))
+	for _, name := range compNames {
+		field, err := resolveField(world, name)
+		if err != nil {
+			return nil, err
+		}
+		if field.index != nil {
+			return nil, fmt.Errorf("expected a component, got field '%s'", name)
+		}
+		ids = append(ids, field.comp)
+	}
+	return ids, nil
+}
+
+// filterSpec holds the options for selecting entities, shared by query-like commands.
+type filterSpec struct {
+	comps     []string
+	with      []string
+	without   []string
+	exclusive bool
+	where     string
+	// Relation targets, like "ChildOf:5".
+	rel []string
+	// Additional components required, e.g. for fields to show.
+	require []ecs.ID
+	// Additional components to exclude.
+	exclude []ecs.ID
+}
+
+// hasOptions returns whether any of the user-facing filter options is set.
+func (s *filterSpec) hasOptions() bool {
+	return len(s.comps) > 0 || len(s.with) > 0 || len(s.without) > 0 || s.exclusive || s.where != "" || len(s.rel) > 0
+}
+
+// entityFilter is a filter with relation targets and an optional where expression.
+type entityFilter struct {
+	filter    ecs.UnsafeFilter
+	relations []ecs.Relation
+	// IDs of the queried components.
+	comps []ecs.ID
+	// Compiled where expression, or nil.
+	where *filterExpr
+}
+
+// query creates a query for the filter.
+func (f *entityFilter) query() ecs.UnsafeQuery {
+	return f.filter.Query(f.relations...)
+}
+
+// newFilter creates a filter from component names, relation targets and an optional where expression.
+// Components referenced by relations and by the expression are added to the filter.
+func newFilter(world *ecs.World, spec filterSpec) (*entityFilter, error) {
+	comps, err := getComponentIDs(world, spec.comps)
+	if err != nil {
+		return nil, err
+	}
+	with, err := getComponentIDs(world, spec.with)
+	if err != nil {
+		return nil, err
+	}
+	without, err := getComponentIDs(world, spec.without)
+	if err != nil {
+		return nil, err
+	}
+	relations, relComps, err := parseRelations(world, spec.rel)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(compNames) > 0 {
-		components := map[string]ecs.ID{}
-		allIDs := ecs.ComponentIDs(world)
+	allComps := make([]ecs.ID, 0, len(comps)+len(with))
+	allComps = append(allComps, comps...)
+	allComps = append(allComps, with...)
+	require := slices.Concat(spec.require, relComps)
 
-		for _, id := range allIDs {
-			info, _ := ecs.ComponentInfo(world, id)
-			components[info.Type.String()] = id
+	var expr *filterExpr
+	if spec.where != "" {
+		if expr, err = compileExpr(world, spec.where); err != nil {
+			return nil, err
+		}
+		require = append(require, expr.comps...)
+	}
+	for _, id := range require {
+		if !slices.Contains(allComps, id) {
+			allComps = append(allComps, id)
 		}
+	}
+
+	without = append(without, spec.exclude...)
 
-		for _, comp := range compNames {
-			if id, ok := components[comp]; ok {
-				ids = append(ids, id)
-			} else {
-				return nil, fmt.Errorf("unknown component type '%s'; did you miss to add the package name?", comp)
-			}
+	filter := ecs.NewUnsafeFilter(world, allComps...).Without(without...)
+	if spec.exclusive {
+		filter = filter.Exclusive()
+	}
+	return &entityFilter{filter: filter, relations: relations, comps: comps, where: expr}, nil
+}
+
+// parseRelations parses relation targets like "ChildOf:5" or "main.ChildOf:5.0".
+// Returns the relations and their component IDs.
+func parseRelations(world *ecs.World, specs []string) ([]ecs.Relation, []ecs.ID, error) {
+	relations := make([]ecs.Relation, 0, len(specs))
+	ids := make([]ecs.ID, 0, len(specs))
+	for _, spec := range specs {
+		name, ref, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid relation '%s'; expected <Component>:<id>[.<gen>]", spec)
+		}
+		id, err := resolveRelation(world, name)
+		if err != nil {
+			return nil, nil, err
 		}
+		if slices.Contains(ids, id) {
+			return nil, nil, fmt.Errorf("duplicate relation '%s'", name)
+		}
+		target, err := resolveEntity(world, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		relations = append(relations, ecs.RelID(id, target))
+		ids = append(ids, id)
 	}
-	return ids, nil
+	return relations, ids, nil
+}
+
+// resolveRelation resolves the name of a relation component, like for [resolveField].
+func resolveRelation(world *ecs.World, name string) (ecs.ID, error) {
+	field, err := resolveField(world, name)
+	if err != nil {
+		return ecs.ID{}, err
+	}
+	if field.index != nil {
+		return ecs.ID{}, fmt.Errorf("expected a relation component, got field '%s'", name)
+	}
+	if info, _ := ecs.ComponentInfo(world, field.comp); !info.IsRelation {
+		return ecs.ID{}, fmt.Errorf("component %s is not a relation", field.compType)
+	}
+	return field.comp, nil
 }
 
 func formatMemory(bytes int) string {